@@ -0,0 +1,74 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+//
+// Runs a local fake Parvati API for trying out the poller without a real
+// Parvati instance. Hosts and waiters for the soku game can be seeded from
+// a JSON file, and every update received can be fetched from /fake/updates.
+//
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"github.com/misatosangel/parvati-soku-checker/pkg/fakeparvati"
+)
+
+// Variables used for command line parameters
+var settings struct {
+	BindAddr string `short:"b" long:"bind" default:"127.0.0.1:8090" description:"Address to bind to"`
+	ListFile string `short:"l" long:"list" value-name:"<path>" description:"JSON file holding the initial soku host list, as {\"hosts\": [...], \"waits\": [...]}"`
+}
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	CliParse()
+	server := fakeparvati.New()
+	server.AddGame(swagger.Game{Id: 1, UrlShortName: "soku", Name: "Touhou 12.3 Hisoutensoku"})
+	if settings.ListFile != "" {
+		fh, err := os.Open(settings.ListFile)
+		if err != nil {
+			log.Fatalln("Unable to open host list:", err)
+		}
+		var list fakeparvati.List
+		err = json.NewDecoder(fh).Decode(&list)
+		fh.Close()
+		if err != nil {
+			log.Fatalln("Unable to read host list:", err)
+		}
+		server.SetHosts("soku", list.Hosts)
+		server.SetWaits("soku", list.Waits)
+		log.Printf("Loaded %d host(s) and %d waiter(s)\n", len(list.Hosts), len(list.Waits))
+	}
+	log.Printf("Fake Parvati API at http://%s%s, updates at http://%s/fake/updates\n", settings.BindAddr, fakeparvati.ApiBase, settings.BindAddr)
+	err := http.ListenAndServe(settings.BindAddr, server.Handler())
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func CliParse() {
+	parser := flags.NewParser(&settings, flags.Default)
+	args, err := parser.Parse()
+	if err != nil {
+		switch err.(type) {
+		case *flags.Error:
+			if err.(*flags.Error).Type == flags.ErrHelp {
+				os.Exit(0)
+			}
+		}
+		log.Fatalln(err)
+	}
+	if len(args) != 0 {
+		log.Fatalln("Passed unexpected extra command line arguments, use -h for help")
+	}
+}
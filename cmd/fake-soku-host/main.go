@@ -0,0 +1,138 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+//
+// Runs a fake hisoutensoku host on a local UDP port, answering checker
+// probes as a waiting or playing game would. Handy for pointing the poller
+// or soku-check-restd at without a real game running.
+//
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+
+	"github.com/misatosangel/parvati-soku-checker/pkg/fakesoku"
+)
+
+// Variables used for command line parameters
+var settings struct {
+	BindAddr   string `short:"b" long:"bind" default:"127.0.0.1:10800" description:"UDP address to answer on"`
+	State      string `short:"s" long:"state" default:"waiting" choice:"waiting" choice:"playing" choice:"down" description:"What the host is doing"`
+	NoSpectate bool   `long:"no-spectate" description:"Refuse spectators while playing"`
+	Roll       string `long:"roll" value-name:"<version>" description:"Accept the game id of this version, e.g. 1.10a. Defaults to plain v1.10a."`
+	AnyRoll    bool   `long:"any-roll" description:"Accept any game id"`
+	GameId     string `long:"game-id" value-name:"<hex>" description:"16 byte game id to accept, as hex, which may be split by spaces, dashes or colons"`
+	Profile1   string `long:"profile1" default:"host" description:"Host profile name"`
+	Profile2   string `long:"profile2" default:"client" description:"Client profile name"`
+	Char1      uint8  `long:"char1" default:"0" value-name:"<id>" description:"Host character id while playing"`
+	Char2      uint8  `long:"char2" default:"0" value-name:"<id>" description:"Client character id while playing"`
+	Deck1      string `long:"deck1" value-name:"<card ids>" description:"Host deck while playing, as comma separated card ids"`
+	Deck2      string `long:"deck2" value-name:"<card ids>" description:"Client deck while playing, as comma separated card ids"`
+	Stage      uint8  `long:"stage" default:"0" value-name:"<id>" description:"Stage id while playing"`
+	Music      uint8  `long:"music" default:"0" value-name:"<id>" description:"Music id while playing"`
+	Seed       uint32 `long:"seed" default:"0" value-name:"<number>" description:"Random seed of the match while playing"`
+}
+
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	CliParse()
+	config := fakesoku.DefaultConfig()
+	switch settings.State {
+	case "playing":
+		config.State = fakesoku.Playing
+	case "down":
+		config.State = fakesoku.Down
+	}
+	config.Spectate = !settings.NoSpectate
+	config.Profiles = [2]string{settings.Profile1, settings.Profile2}
+	if settings.Roll != "" {
+		id, ok := fakesoku.GameIds[strings.ToLower(settings.Roll)]
+		if !ok {
+			log.Fatalf("Unknown version '%s', known versions: %s\n", settings.Roll, strings.Join(knownRolls(), ", "))
+		}
+		config.GameId = id
+	}
+	if settings.GameId != "" {
+		id, err := fakesoku.ParseGameId(settings.GameId)
+		if err != nil {
+			log.Fatalln("Bad game id:", err)
+		}
+		config.GameId = id
+	}
+	config.AnyId = settings.AnyRoll
+	for i, deck := range []string{settings.Deck1, settings.Deck2} {
+		cards, err := parseDeck(deck)
+		if err != nil {
+			log.Fatalf("Bad deck for player %d: %s\n", i+1, err)
+		}
+		config.Players[i].Deck = cards
+	}
+	config.Players[0].Character = settings.Char1
+	config.Players[1].Character = settings.Char2
+	config.Stage = settings.Stage
+	config.Music = settings.Music
+	config.Seed = settings.Seed
+	host, err := fakesoku.Listen(settings.BindAddr, config)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer host.Close()
+	log.Printf("Fake soku host %s on %s, spectate: %t\n", config.State, host.Addr(), config.Spectate)
+	signalC := make(chan os.Signal, 1)
+	signal.Notify(signalC, os.Interrupt)
+	<-signalC
+	log.Printf("Stopping after %d packet(s)\n", host.Received())
+	return 0
+}
+
+// Comma separated card ids
+func parseDeck(deck string) ([]uint16, error) {
+	if deck == "" {
+		return nil, nil
+	}
+	var cards []uint16
+	for _, card := range strings.Split(deck, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(card), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad card id '%s'", card)
+		}
+		cards = append(cards, uint16(id))
+	}
+	return cards, nil
+}
+
+func knownRolls() []string {
+	var names []string
+	for name := range fakesoku.GameIds {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func CliParse() {
+	parser := flags.NewParser(&settings, flags.Default)
+	args, err := parser.Parse()
+	if err != nil {
+		switch err.(type) {
+		case *flags.Error:
+			if err.(*flags.Error).Type == flags.ErrHelp {
+				os.Exit(0)
+			}
+		}
+		log.Fatalln(err)
+	}
+	if len(args) != 0 {
+		log.Fatalln("Passed unexpected extra command line arguments, use -h for help")
+	}
+}
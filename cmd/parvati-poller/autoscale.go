@@ -0,0 +1,118 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Aim to keep this share of the threads busy, leaving room for bursts
+const scaleUtilisation = 0.75
+
+// Grows and shrinks a pool's worker threads between Min and Max, from how
+// long jobs waited in the queue and how long they took to run since the
+// last adjustment, and whether jobs are held back for want of room in the
+// queue. Growing is done at once, shrinking one thread at a time.
+// A nil AutoScaler observes nothing.
+type AutoScaler struct {
+	Min     uint8
+	Max     uint8
+	MaxWait time.Duration // grow if jobs waited longer than this on average
+
+	lock  sync.Mutex
+	jobs  int
+	wait  time.Duration // totals since the last adjustment
+	took  time.Duration
+	since time.Time
+}
+
+// What was seen between adjustments
+type ScaleSample struct {
+	Jobs    int
+	Wait    time.Duration // average time in the queue
+	Took    time.Duration // average time to run
+	Busy    float64       // average threads busy
+	Backlog int           // jobs held back, not fitting in the queue
+}
+
+func NewAutoScaler(min uint8, max uint8, maxWait time.Duration, now time.Time) *AutoScaler {
+	return &AutoScaler{Min: min, Max: max, MaxWait: maxWait, since: now}
+}
+
+// Records how long a job waited in the queue and then took to run
+func (a *AutoScaler) Observe(wait time.Duration, took time.Duration) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.jobs++
+	a.wait += wait
+	a.took += took
+}
+
+// Starts afresh from a size set from outside, so the next adjustment
+// judges it only on what was seen since
+func (a *AutoScaler) Reset(now time.Time) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.jobs, a.wait, a.took, a.since = 0, 0, 0, now
+}
+
+// Brings a thread count within Min and Max, leaving it alone if nil
+func (a *AutoScaler) Clamp(threads uint8) uint8 {
+	if a == nil {
+		return threads
+	}
+	if threads < a.Min {
+		return a.Min
+	}
+	if threads > a.Max {
+		return a.Max
+	}
+	return threads
+}
+
+// The number of threads wanted given the current size and the jobs held
+// back from the queue, starting afresh for the next adjustment
+func (a *AutoScaler) Target(size int, backlog int, now time.Time) (int, ScaleSample) {
+	a.lock.Lock()
+	s := ScaleSample{Jobs: a.jobs, Backlog: backlog}
+	elapsed := now.Sub(a.since)
+	if a.jobs > 0 {
+		s.Wait = a.wait / time.Duration(a.jobs)
+		s.Took = a.took / time.Duration(a.jobs)
+	}
+	if elapsed > 0 {
+		s.Busy = float64(a.took) / float64(elapsed)
+	}
+	a.jobs, a.wait, a.took, a.since = 0, 0, 0, now
+	a.lock.Unlock()
+
+	want := int(math.Ceil(s.Busy / scaleUtilisation))
+	if s.Wait > a.MaxWait || backlog > 0 {
+		// the queue is backing up, more than the run times alone suggest
+		if grown := size + (size+1)/2; grown > want {
+			want = grown
+		}
+	}
+	if want < size {
+		if s.Wait > a.MaxWait/2 || backlog > 0 {
+			want = size // not yet clear of the queue
+		} else {
+			want = size - 1
+		}
+	}
+	if want < int(a.Min) {
+		want = int(a.Min)
+	}
+	if want > int(a.Max) {
+		want = int(a.Max)
+	}
+	return want, s
+}
@@ -0,0 +1,48 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScaleTarget(t *testing.T) {
+	start := time.Unix(1000, 0)
+	for _, tt := range []struct {
+		name    string
+		jobs    int
+		wait    time.Duration
+		took    time.Duration
+		backlog int
+		want    int
+	}{
+		{"idle shrinks by one", 0, 0, 0, 0, 3},
+		{"busy grows to the load", 10, 0, 6 * time.Second, 0, 8},
+		{"long waits grow by half", 10, 2 * time.Second, 0, 0, 6},
+		{"backlog grows by half", 1, 0, 0, 5, 6},
+		{"backlog holds off shrinking", 0, 0, 0, 1, 6},
+		{"never above max", 10, 0, 30 * time.Second, 0, 10},
+	} {
+		a := NewAutoScaler(1, 10, time.Second, start)
+		for i := 0; i < tt.jobs; i++ {
+			a.Observe(tt.wait, tt.took/time.Duration(tt.jobs))
+		}
+		if got, _ := a.Target(4, tt.backlog, start.Add(time.Second)); got != tt.want {
+			t.Errorf("%s: Target() = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestScaleReset(t *testing.T) {
+	start := time.Unix(1000, 0)
+	a := NewAutoScaler(1, 10, time.Second, start)
+	a.Observe(5*time.Second, 5*time.Second)
+	a.Reset(start.Add(time.Second))
+	got, sample := a.Target(8, 0, start.Add(2*time.Second))
+	if sample.Jobs != 0 || got != 7 {
+		t.Errorf("Target() after Reset() = %d from %+v, want the new size judged afresh", got, sample)
+	}
+	var none *AutoScaler
+	none.Reset(start) // must not panic
+}
@@ -0,0 +1,181 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+)
+
+// Name of the section in the gitconfig style file holding poller settings
+const pollerSection = "poller"
+
+// Which config file the poller reads, either given or the default
+func ConfigFilePath() string {
+	if settings.ConfigFile != "" {
+		return settings.ConfigFile
+	}
+	def, _ := parvatigo.DefaultConfigFile()
+	return def
+}
+
+// The settings that may change while running, on SIGHUP. Workers take a
+// copy with CurrentTunables rather than reading settings.
+type Tunables struct {
+	Frequency time.Duration
+	Threads   uint8
+	Timeout   time.Duration
+	Updates   bool
+}
+
+// The long flag names of the tunables, as both flags and [poller] keys
+var tunableKeys = []string{"frequency", "threads", "timeout", "update"}
+
+var (
+	tunables atomic.Value // Tunables
+	// the tunables as given on the command line, and which were given
+	// explicitly, so that they keep winning over the config file on reload
+	cliTunables Tunables
+	cliExplicit = make(map[string]bool)
+)
+
+// The tunables currently in force
+func CurrentTunables() Tunables {
+	t, _ := tunables.Load().(Tunables)
+	return t
+}
+
+func SetTunables(t Tunables) {
+	tunables.Store(t)
+}
+
+// Notes the tunables from the parsed command line
+func captureCliTunables(parser *flags.Parser) {
+	cliTunables = Tunables{
+		Frequency: settings.Frequency,
+		Threads:   settings.Threads,
+		Timeout:   settings.Timeout,
+		Updates:   settings.Updates,
+	}
+	for _, key := range tunableKeys {
+		if opt := parser.FindOptionByLongName(key); opt != nil && opt.IsSet() {
+			cliExplicit[key] = true
+		}
+	}
+}
+
+// Works out the tunables from the command line and any [poller] section in
+// the config file. Supported keys are frequency, threads, timeout and
+// update; a flag given on the command line wins over the same key in the
+// file. A missing config file or section leaves the command line values.
+func LoadTunables() (Tunables, error) {
+	next := cliTunables
+	path := ConfigFilePath()
+	if path != "" {
+		vals, err := ReadConfigSection(path, pollerSection)
+		if err != nil && !os.IsNotExist(err) {
+			return next, err
+		}
+		if err := applyPollerConfig(&next, vals, cliExplicit); err != nil {
+			return next, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+	if settings.Results != "" {
+		next.Updates = true
+	} else if settings.Replay != "" {
+		next.Updates = false
+	}
+	return next, nil
+}
+
+// Sets the tunables from the [poller] section values, skipping those in skip
+func applyPollerConfig(t *Tunables, vals map[string]string, skip map[string]bool) error {
+	for key, val := range vals {
+		if skip[key] {
+			continue
+		}
+		var err error
+		switch key {
+		case "frequency":
+			t.Frequency, err = time.ParseDuration(val)
+		case "timeout":
+			t.Timeout, err = time.ParseDuration(val)
+		case "threads":
+			var n uint64
+			n, err = strconv.ParseUint(val, 10, 8)
+			t.Threads = uint8(n)
+		case "update":
+			t.Updates, err = parseConfigBool(val)
+		default:
+			err = fmt.Errorf("unknown key")
+		}
+		if err != nil {
+			return fmt.Errorf("bad value for %s.%s '%s': %s", pollerSection, key, val, err.Error())
+		}
+	}
+	if t.Frequency <= 0 {
+		return fmt.Errorf("%s.frequency must be positive", pollerSection)
+	}
+	if t.Threads == 0 {
+		return fmt.Errorf("%s.threads must be at least 1", pollerSection)
+	}
+	return nil
+}
+
+// Minimal gitconfig reader returning the lower-cased keys and values of a
+// single section. Later values for the same key win.
+func ReadConfigSection(path string, section string) (map[string]string, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	vals := make(map[string]string)
+	inSection := false
+	scanner := bufio.NewScanner(fh)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("%s: bad section header: %s", path, line)
+			}
+			inSection = strings.EqualFold(strings.TrimSpace(line[1:end]), section)
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		key, val := line, "true" // a bare key is a boolean true in gitconfig
+		if eq := strings.IndexByte(line, '='); eq >= 0 {
+			key = strings.TrimSpace(line[:eq])
+			val = strings.TrimSpace(line[eq+1:])
+		}
+		if unq, err := strconv.Unquote(val); err == nil {
+			val = unq
+		}
+		vals[strings.ToLower(key)] = val
+	}
+	return vals, scanner.Err()
+}
+
+func parseConfigBool(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("not a boolean")
+}
@@ -0,0 +1,73 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testConfig = `[parvatigo]
+	password = secret
+[poller]
+	frequency = 10s
+	threads = 8
+	timeout = "2s"
+	update
+`
+
+func TestReadConfigSection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(path, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	vals, err := ReadConfigSection(path, "Poller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"frequency": "10s", "threads": "8", "timeout": "2s", "update": "true"}
+	if len(vals) != len(want) {
+		t.Fatalf("ReadConfigSection() = %v, want %v", vals, want)
+	}
+	for k, v := range want {
+		if vals[k] != v {
+			t.Errorf("%s = %q, want %q", k, vals[k], v)
+		}
+	}
+}
+
+func TestExplicitFlagsWinOverConfig(t *testing.T) {
+	vals := map[string]string{"frequency": "10s", "threads": "8", "timeout": "2s", "update": "true"}
+	tune := Tunables{Frequency: 5 * time.Second, Threads: 3, Timeout: time.Second}
+	if err := applyPollerConfig(&tune, vals, map[string]bool{"threads": true, "update": true}); err != nil {
+		t.Fatal(err)
+	}
+	want := Tunables{Frequency: 10 * time.Second, Threads: 3, Timeout: 2 * time.Second}
+	if tune != want {
+		t.Errorf("got %+v, want %+v", tune, want)
+	}
+}
+
+func TestBadPollerConfig(t *testing.T) {
+	for _, vals := range []map[string]string{
+		{"frequency": "often"},
+		{"frequency": "0s"},
+		{"threads": "0"},
+		{"threads": "300"},
+		{"update": "maybe"},
+		{"colour": "blue"},
+	} {
+		tune := Tunables{Frequency: time.Second, Threads: 1}
+		if err := applyPollerConfig(&tune, vals, nil); err == nil {
+			t.Errorf("%v accepted, want an error", vals)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// Per host debouncing state
+type hostDebounce struct {
+	confirmed string // status last reported (or listed when first seen)
+	pending   string // status waiting to be confirmed
+	seen      int    // consecutive checks which found the pending status
+}
+
+// Holds back status changes until they have been seen on enough consecutive
+// checks, so a single flaky probe does not flip a host's status on Parvati.
+type Debouncer struct {
+	Up   int // checks needed to confirm a change to a good (up) status
+	Down int // checks needed to confirm a change to any other status
+
+	lock  sync.Mutex
+	hosts map[int64]*hostDebounce
+}
+
+func NewDebouncer(up, down int) *Debouncer {
+	return &Debouncer{
+		Up:    up,
+		Down:  down,
+		hosts: make(map[int64]*hostDebounce),
+	}
+}
+
+// What to do with the status found by a check
+type Decision struct {
+	Report  bool   // whether the status should be reported
+	Changed bool   // whether it is a confirmed change from the last reported status
+	From    string // the last reported status
+	Seen    int    // if not reported, times the new status has been seen so far
+	Need    int    // if not reported, times it needs to be seen
+}
+
+// Records a check on a host which found the given status.
+func (d *Debouncer) Observe(hs *swagger.HosterStatus, status string, up bool) Decision {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	st, ok := d.hosts[hs.Host.BaseInfo.Id]
+	if !ok {
+		st = &hostDebounce{confirmed: hs.Status.Status}
+		d.hosts[hs.Host.BaseInfo.Id] = st
+	}
+	if status == st.confirmed {
+		st.pending, st.seen = "", 0
+		return Decision{Report: true, From: st.confirmed}
+	}
+	if status == st.pending {
+		st.seen++
+	} else {
+		st.pending, st.seen = status, 1
+	}
+	need := d.Down
+	if up {
+		need = d.Up
+	}
+	if st.seen < need {
+		return Decision{From: st.confirmed, Seen: st.seen, Need: need}
+	}
+	from := st.confirmed
+	st.confirmed, st.pending, st.seen = status, "", 0
+	return Decision{Report: true, Changed: true, From: from}
+}
+
+// Drops state for any host not in the given list.
+func (d *Debouncer) Prune(hosts []swagger.HosterStatus) {
+	listed := make(map[int64]bool, len(hosts))
+	for _, hs := range hosts {
+		listed[hs.Host.BaseInfo.Id] = true
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for id := range d.hosts {
+		if !listed[id] {
+			delete(d.hosts, id)
+		}
+	}
+}
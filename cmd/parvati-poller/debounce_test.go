@@ -0,0 +1,79 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+func TestDebounce(t *testing.T) {
+	type check struct {
+		status  string
+		up      bool
+		report  bool
+		changed bool
+		from    string
+	}
+	for _, tt := range []struct {
+		name   string
+		up     int
+		down   int
+		listed string
+		checks []check
+	}{
+		{"unchanged", 1, 2, "Waiting", []check{
+			{"Waiting", true, true, false, "Waiting"},
+		}},
+		{"up at once", 1, 2, "Down", []check{
+			{"Waiting", true, true, true, "Down"},
+		}},
+		{"down confirmed", 1, 2, "Waiting", []check{
+			{"Down", false, false, false, "Waiting"},
+			{"Down", false, true, true, "Waiting"},
+			{"Down", false, true, false, "Down"},
+		}},
+		{"flaky probe", 1, 2, "Waiting", []check{
+			{"Down", false, false, false, "Waiting"},
+			{"Waiting", true, true, false, "Waiting"},
+			{"Down", false, false, false, "Waiting"}, // counting starts again
+		}},
+		{"pending replaced", 2, 2, "Down", []check{
+			{"Waiting", true, false, false, "Down"},
+			{"Playing", true, false, false, "Down"},
+			{"Playing", true, true, true, "Down"},
+		}},
+		{"no confirming", 0, 0, "Waiting", []check{
+			{"Down", false, true, true, "Waiting"},
+			{"Playing", true, true, true, "Down"},
+		}},
+	} {
+		d := NewDebouncer(tt.up, tt.down)
+		hs := testHost(1, tt.listed)
+		for i, c := range tt.checks {
+			got := d.Observe(&hs, c.status, c.up)
+			if got.Report != c.report || got.Changed != c.changed || got.From != c.from {
+				t.Errorf("%s: check %d found %s: %+v, want report %t changed %t from %s", tt.name, i, c.status, got, c.report, c.changed, c.from)
+			}
+			if !got.Report && (got.Seen < 1 || got.Need <= got.Seen) {
+				t.Errorf("%s: check %d held back having seen %d of %d", tt.name, i, got.Seen, got.Need)
+			}
+		}
+	}
+}
+
+func TestDebouncePrune(t *testing.T) {
+	d := NewDebouncer(1, 2)
+	gone, kept := testHost(1, "Waiting"), testHost(2, "Waiting")
+	d.Observe(&gone, "Down", false)
+	d.Observe(&kept, "Down", false)
+	d.Prune([]swagger.HosterStatus{kept})
+	if got := d.Observe(&kept, "Down", false); !got.Changed {
+		t.Errorf("listed host's pending change forgotten: %+v", got)
+	}
+	// relisted, so starts again from its listed status
+	if got := d.Observe(&gone, "Down", false); got.Report {
+		t.Errorf("pruned host's pending change kept: %+v", got)
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"github.com/misatosangel/soku-net-checker/pkg/checker"
+)
+
+// Picks how deep to check each host. In order of precedence: a level set
+// for the host, the full level every FullEvery checks of a host, a level set
+// for the host's listed status, then the default.
+type CheckDepth struct {
+	Default   uint
+	ByStatus  map[string]uint // by lower case status
+	ByHost    map[int64]uint
+	Full      uint
+	FullEvery int // 0 for never
+
+	lock   sync.Mutex
+	counts map[int64]int // checks of each host so far
+}
+
+// Builds the check depth from the --check-level options. Checks past basic
+// follow redirects the probe guard never sees, so unless it allows them the
+// default is basic and asking for more is an error.
+func SettingsCheckDepth() (*CheckDepth, error) {
+	d := &CheckDepth{
+		Default:   checker.STATE_SPEC_REACH_RELAY,
+		ByStatus:  make(map[string]uint),
+		ByHost:    make(map[int64]uint),
+		FullEvery: settings.FullEvery,
+		counts:    make(map[int64]int),
+	}
+	var err error
+	if settings.Level != "" {
+		if d.Default, err = parseLevel(settings.Level); err != nil {
+			return nil, err
+		}
+	} else if guard.Redirects() != nil {
+		d.Default = checker.STATE_BASIC
+	}
+	if d.Full, err = parseLevel(settings.FullLevel); err != nil {
+		return nil, err
+	}
+	for _, o := range settings.LevelBy {
+		status, level, err := parseLevelOverride(o)
+		if err != nil {
+			return nil, err
+		}
+		d.ByStatus[strings.ToLower(status)] = level
+	}
+	for _, o := range settings.LevelHost {
+		host, level, err := parseLevelOverride(o)
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.ParseInt(host, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Bad host id in '%s'", o)
+		}
+		d.ByHost[id] = level
+	}
+	if err := guard.Redirects(); err != nil && d.redirecting() {
+		return nil, fmt.Errorf("%s, check at basic or give --probe-follow-redirects", err.Error())
+	}
+	return d, nil
+}
+
+// Whether any level in use goes past basic
+func (d *CheckDepth) redirecting() bool {
+	levels := []uint{d.Default}
+	if d.FullEvery > 0 {
+		levels = append(levels, d.Full)
+	}
+	for _, level := range d.ByStatus {
+		levels = append(levels, level)
+	}
+	for _, level := range d.ByHost {
+		levels = append(levels, level)
+	}
+	for _, level := range levels {
+		if level > checker.STATE_BASIC {
+			return true
+		}
+	}
+	return false
+}
+
+// The level to check the host at next, counting the check. Call as the
+// check is made, so jobs which never run are not counted.
+func (d *CheckDepth) Level(hs *swagger.HosterStatus) uint {
+	id := hs.Host.BaseInfo.Id
+	d.lock.Lock()
+	d.counts[id]++
+	count := d.counts[id]
+	d.lock.Unlock()
+	if level, ok := d.ByHost[id]; ok {
+		return level
+	}
+	if d.FullEvery > 0 && count%d.FullEvery == 0 {
+		return d.Full
+	}
+	if level, ok := d.ByStatus[strings.ToLower(hs.Status.Status)]; ok {
+		return level
+	}
+	return d.Default
+}
+
+// Forgets hosts no longer listed
+func (d *CheckDepth) Prune(hosts []swagger.HosterStatus) {
+	listed := make(map[int64]bool, len(hosts))
+	for _, hs := range hosts {
+		listed[hs.Host.BaseInfo.Id] = true
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for id := range d.counts {
+		if !listed[id] {
+			delete(d.counts, id)
+		}
+	}
+}
+
+func parseLevel(name string) (uint, error) {
+	level, err := checker.ParseToState(strings.ToLower(name))
+	if err != nil {
+		return 0, fmt.Errorf("Unknown check level '%s': %s", name, err.Error())
+	}
+	return level, nil
+}
+
+// <key>=<level>
+func parseLevelOverride(o string) (string, uint, error) {
+	parts := strings.SplitN(o, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", 0, fmt.Errorf("Bad check level override '%s', expected <name>=<level>", o)
+	}
+	level, err := parseLevel(parts[1])
+	return parts[0], level, err
+}
@@ -0,0 +1,75 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-soku-checker/pkg/netguard"
+	"github.com/misatosangel/soku-net-checker/pkg/checker"
+)
+
+// Only checks which run count towards --full-every
+func TestFullEveryCountsRunChecks(t *testing.T) {
+	sink := &testSink{}
+	pool := newTestPool(sink, 4)
+	pool.depth = &CheckDepth{Default: 1, Full: 3, FullEvery: 2, counts: make(map[int64]int)}
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	var lock sync.Mutex
+	var levels []uint
+	pool.check = func(j *Job) (*parvatigo.StatusUpdate, *checker.CheckResult, error) {
+		lock.Lock()
+		levels = append(levels, j.ToPoint)
+		lock.Unlock()
+		started <- struct{}{}
+		<-release
+		result := &checker.CheckResult{Address: j.Request.Address, Status: "Waiting"}
+		return StatusFromResult(j, result, time.Now()), result, nil
+	}
+	pool.Resize(1)
+	pool.Enqueue(hostJob(t, testHost(1, "Down")))
+	<-started
+	for i := 0; i < 3; i++ {
+		if got := pool.Enqueue(hostJob(t, testHost(1, "Down"))); got != QueuedInFlight {
+			t.Fatalf("Enqueue() of a host being checked = %d, want QueuedInFlight", got)
+		}
+	}
+	release <- struct{}{}
+	for pool.inFlight.Len() != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	pool.Enqueue(hostJob(t, testHost(1, "Down")))
+	<-started
+	close(release)
+	pool.Shutdown(0)
+	if len(levels) != 2 || levels[0] != 1 || levels[1] != 3 {
+		t.Errorf("checked at levels %v, want [1 3] with the skipped jobs not counted", levels)
+	}
+}
+
+func TestLevelsPastBasicNeedRedirects(t *testing.T) {
+	old, oldSettings := guard, settings
+	t.Cleanup(func() { guard, settings = old, oldSettings })
+	var err error
+	if guard, err = netguard.New(nil, nil, netguard.Limits{}); err != nil {
+		t.Fatal(err)
+	}
+	settings.FullLevel = "basic"
+	d, err := SettingsCheckDepth()
+	if err != nil || d.Default != checker.STATE_BASIC {
+		t.Fatalf("SettingsCheckDepth() = %+v, %v, want a basic default without --probe-follow-redirects", d, err)
+	}
+	settings.LevelBy = []string{"Playing=full"}
+	if _, err := SettingsCheckDepth(); err == nil {
+		t.Error("SettingsCheckDepth() of a level past basic succeeded without --probe-follow-redirects")
+	}
+	guard.FollowRedirects = true
+	settings.LevelBy = nil
+	if d, err = SettingsCheckDepth(); err != nil || d.Default != checker.STATE_SPEC_REACH_RELAY {
+		t.Errorf("SettingsCheckDepth() = %+v, %v, want the spectator relay default with --probe-follow-redirects", d, err)
+	}
+}
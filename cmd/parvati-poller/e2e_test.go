@@ -0,0 +1,214 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"github.com/misatosangel/parvati-soku-checker/pkg/fakeparvati"
+	"github.com/misatosangel/parvati-soku-checker/pkg/fakesoku"
+	"github.com/misatosangel/parvati-soku-checker/pkg/netguard"
+	"github.com/misatosangel/soku-net-checker/pkg/checker"
+)
+
+// Lets checks at any level reach fake hosts on the loopback address
+func allowLoopback(t *testing.T) {
+	g, err := netguard.New(nil, []string{"127.0.0.1/32"}, netguard.Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.FollowRedirects = true // the fakes never redirect
+	old, oldTune := guard, CurrentTunables()
+	guard = g
+	SetTunables(Tunables{Frequency: time.Second, Threads: 2, Timeout: 500 * time.Millisecond, Updates: true})
+	t.Cleanup(func() {
+		guard = old
+		SetTunables(oldTune)
+	})
+}
+
+// Serves a soku game on a fake Parvati listing one host, id 1 following
+// check 40, at the fake soku host, and user 7 waiting
+func fakeParvati(t *testing.T, host *fakesoku.Host) (*fakeparvati.Server, *httptest.Server) {
+	ip, port, _ := net.SplitHostPort(host.Addr())
+	portNum, _ := strconv.Atoi(port)
+	server := fakeparvati.New()
+	server.AddGame(swagger.Game{Id: 1, UrlShortName: "soku", Name: "Touhou 12.3 Hisoutensoku"})
+	var hs swagger.HosterStatus
+	hs.Host.BaseInfo.Id = 1
+	hs.Host.Ipv4 = ip
+	hs.Host.Port = int32(portNum)
+	hs.Status.Id = 40
+	hs.Status.Status = "Down"
+	server.SetHosts("soku", []swagger.HosterStatus{hs})
+	var ws swagger.WaiterStatus
+	ws.Waiter.User.Id = 7
+	server.SetWaits("soku", []swagger.WaiterStatus{ws})
+	web := server.Start()
+	t.Cleanup(web.Close)
+	return server, web
+}
+
+// Lists, checks and updates a host and ends a wait through the real API
+// client, so the fake's routes are those the client actually calls
+func TestPollFakeParvati(t *testing.T) {
+	allowLoopback(t)
+	host := fakeHost(t, fakesoku.Waiting)
+	server, web := fakeParvati(t, host)
+
+	api, err := parvatigo.NewApi(&parvatigo.ApiConfig{URI: web.URL + fakeparvati.ApiBase, Username: "test", Password: "test"}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	soku, err := FindSokuGame(&api)
+	if err != nil {
+		t.Fatalf("FindSokuGame() failed: %s", err)
+	}
+	client := NewParvatiClient(&api, soku)
+	list, err := client.ListHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Hosts) != 1 || len(list.Waits) != 1 {
+		t.Fatalf("ListHosts() = %+v, want the host and the waiter", list)
+	}
+
+	pool := newTestPool(client, 4)
+	pool.Resize(2)
+	req, fallback, err := HostToCheckReq(&list.Hosts[0].Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Enqueue(&Job{Request: req, Fallback: fallback, ToPoint: checker.STATE_SPEC_REACH_RELAY, OrigHostStat: list.Hosts[0], Game: soku})
+	pool.Enqueue(&Job{WaitStat: list.Waits[0], Game: soku})
+	pool.Shutdown(0)
+
+	if host.Received() == 0 {
+		t.Error("fake host was never probed")
+	}
+	up := checkSent(t, server)
+	list, err = client.ListHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Waits) != 0 {
+		t.Errorf("ended wait still listed: %+v", list.Waits)
+	}
+	if got := list.Hosts[0].Status; got.Id != up.CheckId || got.Status != up.Status.Status {
+		t.Errorf("listed status %+v does not reflect update %+v", got, up)
+	}
+}
+
+// Checks the fake Parvati got one update for host 1 and user 7's wait ended
+func checkSent(t *testing.T, server *fakeparvati.Server) fakeparvati.Update {
+	updates := server.Updates()
+	if len(updates) != 1 {
+		t.Fatalf("got %d status updates, want 1: %+v", len(updates), updates)
+	}
+	up := updates[0]
+	if up.Game != "soku" || up.HosterId != 1 || up.Status.LastCheckId != 40 || up.Status.Status == "" {
+		t.Errorf("got update %+v, want a status for host 1 following check 40", up)
+	}
+	waits := server.WaitUpdates()
+	if len(waits) != 1 || waits[0].UserId != 7 || waits[0].Minutes != 0 {
+		t.Errorf("got wait updates %+v, want user 7's wait ended", waits)
+	}
+	return up
+}
+
+// Runs the poller's main loop once against the fakes, as from the command line
+func TestRunOnce(t *testing.T) {
+	allowLoopback(t)
+	host := fakeHost(t, fakesoku.Waiting)
+	server, web := fakeParvati(t, host)
+	dir, err := ioutil.TempDir("", "poller")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config")
+	if err := ioutil.WriteFile(config, []byte("[parvatigo]\n\tpassword = test\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	oldArgs, oldSettings, oldGuard := os.Args, settings, guard
+	oldCli, oldExplicit := cliTunables, cliExplicit
+	t.Cleanup(func() {
+		os.Args, settings, guard = oldArgs, oldSettings, oldGuard
+		cliTunables, cliExplicit = oldCli, oldExplicit
+	})
+	cliExplicit = make(map[string]bool)
+	os.Args = []string{"parvati-poller", "--once", "--update",
+		"-c", config, "-u", "test", "--uri", web.URL + fakeparvati.ApiBase,
+		"--frequency", "50ms", "--threads", "2", "--timeout", "500ms", "--retries", "1",
+		"--allow-cidr", "127.0.0.1/32", "--probe-follow-redirects"}
+	if code := run(); code != 0 {
+		t.Fatalf("run() = %d, want 0", code)
+	}
+	if host.Received() == 0 {
+		t.Error("fake host was never probed")
+	}
+	checkSent(t, server)
+}
+
+func fakeHost(t *testing.T, state fakesoku.State) *fakesoku.Host {
+	config := fakesoku.DefaultConfig()
+	config.State = state
+	host, err := fakesoku.Listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { host.Close() })
+	return host
+}
+
+func TestCheckHost(t *testing.T) {
+	allowLoopback(t)
+	up, down := fakeHost(t, fakesoku.Waiting), fakeHost(t, fakesoku.Down)
+	request := func(host *fakesoku.Host) *checker.Request {
+		req, err := checker.NewRequest(host.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Timeout = CurrentTunables().Timeout
+		return req
+	}
+	hs := testHost(3, "Down")
+	hs.Status.Id = 12
+	for _, tt := range []struct {
+		name     string
+		job      *Job
+		up       bool
+		answered *fakesoku.Host
+	}{
+		{"up", &Job{Request: request(up), ToPoint: checker.STATE_SPEC_REACH_RELAY, OrigHostStat: hs}, true, up},
+		{"down", &Job{Request: request(down), ToPoint: checker.STATE_SPEC_REACH_RELAY, OrigHostStat: hs}, false, down},
+		{"fallback", &Job{Request: request(down), Fallback: request(up), ToPoint: checker.STATE_SPEC_REACH_RELAY, OrigHostStat: hs}, true, up},
+	} {
+		su, result, err := CheckHost(tt.job)
+		if err != nil {
+			t.Errorf("%s: CheckHost() failed: %s", tt.name, err)
+			continue
+		}
+		if result.GoodStatus() != tt.up {
+			t.Errorf("%s: CheckHost() = %s, want up %t", tt.name, result, tt.up)
+		}
+		if result.Address != tt.answered.Addr() {
+			t.Errorf("%s: answered by %s, want %s", tt.name, result.Address, tt.answered.Addr())
+		}
+		if su.HosterId != 3 || su.LastCheckId != 12 || su.Status != result.Status {
+			t.Errorf("%s: update %+v does not follow check 12 of host 3 with status %s", tt.name, su, result.Status)
+		}
+	}
+	if _, _, err := CheckHost(&Job{OrigHostStat: hs}); err == nil {
+		t.Error("CheckHost() of a job without a request succeeded")
+	}
+}
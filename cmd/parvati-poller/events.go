@@ -0,0 +1,67 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-soku-checker/pkg/geoip"
+	"github.com/misatosangel/soku-net-checker/pkg/checker"
+)
+
+// One check of a host, as written out in JSON lines mode
+type CheckEvent struct {
+	Time     time.Time               `json:"time"`
+	Thread   uint8                   `json:"thread"`
+	HostId   int64                   `json:"host_id"`
+	Address  string                  `json:"address"`
+	Family   string                  `json:"family,omitempty"` // of the address which answered
+	HostGeo  *geoip.Location         `json:"host_geo,omitempty"`
+	OppGeo   *geoip.Location         `json:"opponent_geo,omitempty"`
+	Level    uint                    `json:"level"` // checker state checked up to
+	Previous string                  `json:"previous_status"`
+	Status   string                  `json:"status,omitempty"`
+	Update   *parvatigo.StatusUpdate `json:"update,omitempty"`
+	Game     *checker.GameInfo       `json:"game,omitempty"` // if checked deep enough to see a match
+	Report   bool                    `json:"report"`         // false if the change is still being confirmed
+	Duration time.Duration           `json:"duration_ns"`
+	Error    string                  `json:"error,omitempty"`
+}
+
+// Writes events as one JSON object per line, safe for use by many workers
+type EventWriter struct {
+	lock sync.Mutex
+	out  io.WriteCloser
+	enc  *json.Encoder
+}
+
+// Opens the given file for appending events, "-" for stdout
+func OpenEventWriter(path string) (*EventWriter, error) {
+	out := io.WriteCloser(os.Stdout)
+	if path != "-" {
+		fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out = fh
+	}
+	return &EventWriter{out: out, enc: json.NewEncoder(out)}, nil
+}
+
+func (w *EventWriter) Write(ev *CheckEvent) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.enc.Encode(ev)
+}
+
+func (w *EventWriter) Close() error {
+	if w.out == os.Stdout {
+		return nil
+	}
+	return w.out.Close()
+}
@@ -0,0 +1,190 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"github.com/misatosangel/parvati-soku-checker/pkg/geoip"
+)
+
+// A host as listed in a hosts file
+type FileHost struct {
+	Id      int64  `json:"id" yaml:"id"`
+	Name    string `json:"name" yaml:"name"`
+	Ipv4    string `json:"ipv4,omitempty" yaml:"ipv4"`
+	Ipv6    string `json:"ipv6,omitempty" yaml:"ipv6"`
+	Port    int32  `json:"port" yaml:"port"`
+	Version string `json:"version,omitempty" yaml:"version"` // sokuroll version, if known
+}
+
+// Reads hosts from a YAML (or JSON) file of the form:
+//
+//	hosts:
+//	  - id: 1
+//	    name: somebody
+//	    ipv4: 192.0.2.1
+//	    port: 10800
+//
+// The file is re-read on every call so it can be edited while running.
+// There are never any waiters.
+type FileSource struct {
+	Path string
+
+	lock sync.Mutex
+	last map[int64]string // status last reported per host, see FileSink
+}
+
+func (s *FileSource) String() string {
+	return "file " + s.Path
+}
+
+func (s *FileSource) ListHosts() (*HostList, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	var file struct {
+		Hosts []FileHost `yaml:"hosts"`
+	}
+	// YAML being a superset of JSON this reads both
+	err = yaml.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", s.Path, err.Error())
+	}
+	list := &HostList{}
+	for _, fh := range file.Hosts {
+		hs := swagger.HosterStatus{}
+		hs.Host.BaseInfo.Id = fh.Id
+		hs.Host.BaseInfo.DisplayName = fh.Name
+		hs.Host.Ipv4 = fh.Ipv4
+		hs.Host.Ipv6 = fh.Ipv6
+		hs.Host.Port = fh.Port
+		hs.Host.Version = fh.Version
+		hs.Status.Status = s.lastStatus(fh.Id)
+		list.Hosts = append(list.Hosts, hs)
+	}
+	return list, nil
+}
+
+// Remembers the status reported for a host, so it is listed with it next time
+func (s *FileSource) SetStatus(hostId int64, status string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.last == nil {
+		s.last = make(map[int64]string)
+	}
+	s.last[hostId] = status
+}
+
+func (s *FileSource) lastStatus(hostId int64) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	status, ok := s.last[hostId]
+	if !ok {
+		return "Unknown"
+	}
+	return status
+}
+
+// A host's latest result as written by a FileSink
+type FileResult struct {
+	HostId   int64           `json:"host_id"`
+	Name     string          `json:"name"`
+	Address  string          `json:"address"`
+	Status   string          `json:"status"`
+	Checked  time.Time       `json:"checked"`
+	Spectate *bool           `json:"spectate,omitempty"`
+	Version  string          `json:"version,omitempty"`
+	Profiles []string        `json:"profiles,omitempty"` // host then client, "" if not known
+	Opponent string          `json:"opponent,omitempty"`
+	HostGeo  *geoip.Location `json:"host_geo,omitempty"`
+	OppGeo   *geoip.Location `json:"opponent_geo,omitempty"`
+}
+
+// Writes results to a JSON file holding the latest result for every host,
+// rewritten on each update, or as JSON lines to stdout if the path is "-".
+// If a FileSource is given it is told of each status, standing in for the
+// status Parvati would list.
+type FileSink struct {
+	Path   string
+	Source *FileSource
+
+	lock    sync.Mutex
+	results map[int64]*FileResult
+}
+
+func NewFileSink(path string, source *FileSource) *FileSink {
+	return &FileSink{Path: path, Source: source, results: make(map[int64]*FileResult)}
+}
+
+func (s *FileSink) UpdateHostStatus(j *Job, su *parvatigo.StatusUpdate) error {
+	r := &FileResult{
+		HostId:   su.HosterId,
+		Name:     j.OrigHostStat.Host.BaseInfo.DisplayName,
+		Address:  j.Request.Address,
+		Status:   su.Status,
+		Checked:  su.CheckDate,
+		Spectate: su.CanSpec,
+		Opponent: su.OpponentAddr,
+		HostGeo:  geo.Lookup(j.Request.Address),
+		OppGeo:   geo.Lookup(su.OpponentAddr),
+	}
+	if su.NewVers != nil {
+		r.Version = *su.NewVers
+	}
+	r.Profiles = UpdateProfiles(su)
+	if s.Source != nil {
+		s.Source.SetStatus(r.HostId, r.Status)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.Path == "-" {
+		return json.NewEncoder(os.Stdout).Encode(r)
+	}
+	s.results[r.HostId] = r
+	return s.write()
+}
+
+// Waiters only come from Parvati, so there is nothing to do
+func (s *FileSink) EndWait(j *Job) error {
+	return nil
+}
+
+// Writes all results, ordered by host id, replacing the file atomically.
+// Call with the lock held.
+func (s *FileSink) write() error {
+	out := make([]*FileResult, 0, len(s.results))
+	for _, r := range s.results {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].HostId < out[j].HostId })
+	data, err := json.MarshalIndent(out, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), ".results-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
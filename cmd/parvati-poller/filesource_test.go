@@ -0,0 +1,53 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+)
+
+func TestFileSinkProfiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "results")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "results.json")
+	sink := NewFileSink(path, nil)
+	alice, bob := "alice", "bob"
+	for _, su := range []*parvatigo.StatusUpdate{
+		{HosterId: 1, Status: "Waiting", Prof1Name: &alice},
+		{HosterId: 2, Status: "Playing", Prof2Name: &bob},
+		{HosterId: 3, Status: "Playing", Prof1Name: &alice, Prof2Name: &bob},
+		{HosterId: 4, Status: "Down"},
+	} {
+		su.CheckDate = time.Now()
+		if err := sink.UpdateHostStatus(hostJob(t, testHost(su.HosterId, "Down")), su); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []FileResult
+	if err := json.Unmarshal(data, &results); err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"alice", ""}, {"", "bob"}, {"alice", "bob"}, nil}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, r := range results {
+		if len(r.Profiles) != len(want[i]) || len(r.Profiles) == 2 && (r.Profiles[0] != want[i][0] || r.Profiles[1] != want[i][1]) {
+			t.Errorf("host %d has profiles %q, want %q", r.HostId, r.Profiles, want[i])
+		}
+	}
+}
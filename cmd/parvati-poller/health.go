@@ -0,0 +1,146 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Tracks how recently the poller made progress, for /healthz and /readyz.
+// A nil Health ignores everything it is told.
+type Health struct {
+	// unix nanoseconds, updated atomically so first to be 64-bit aligned on
+	// 32-bit platforms
+	lastList   int64
+	lastUpdate int64
+	lastCheck  int64
+
+	MaxListAge   time.Duration // since the last successful host list fetch
+	MaxUpdateAge time.Duration // since the last successful update, while checks are being made
+	MaxBusy      time.Duration // a worker on one job for longer is stuck
+	MaxBacklog   int           // due jobs waiting for room in the queue
+
+	pool    *Pool
+	started time.Time
+}
+
+// The state reported by both endpoints
+type HealthReport struct {
+	Healthy    bool      `json:"healthy"`
+	Ready      bool      `json:"ready"`
+	Problems   []string  `json:"problems,omitempty"`
+	LastList   time.Time `json:"last_list_fetch"`
+	LastUpdate time.Time `json:"last_update"`
+	LastCheck  time.Time `json:"last_check"`
+	Workers    int       `json:"workers"`
+	Stuck      int       `json:"stuck_workers"`
+	Queued     int       `json:"queued"`
+	Backlog    int       `json:"backlog"`
+	Updating   bool      `json:"updating"`
+}
+
+func NewHealth(pool *Pool) *Health {
+	return &Health{pool: pool, started: time.Now()}
+}
+
+func (h *Health) ListFetched(when time.Time) {
+	if h != nil {
+		atomic.StoreInt64(&h.lastList, when.UnixNano())
+	}
+}
+
+func (h *Health) Updated(when time.Time) {
+	if h != nil {
+		atomic.StoreInt64(&h.lastUpdate, when.UnixNano())
+	}
+}
+
+func (h *Health) Checked(when time.Time) {
+	if h != nil {
+		atomic.StoreInt64(&h.lastCheck, when.UnixNano())
+	}
+}
+
+// Works out the current state.
+// Unhealthy (worth restarting) means workers are stuck or the host list has
+// not been fetched for too long. Unready additionally covers never having
+// fetched the list, updates failing while checks are made and a backed up
+// queue.
+func (h *Health) Report(now time.Time) *HealthReport {
+	r := &HealthReport{
+		LastList:   unixTime(atomic.LoadInt64(&h.lastList)),
+		LastUpdate: unixTime(atomic.LoadInt64(&h.lastUpdate)),
+		LastCheck:  unixTime(atomic.LoadInt64(&h.lastCheck)),
+		Workers:    h.pool.Size(),
+		Stuck:      h.pool.Stuck(now, h.MaxBusy),
+		Queued:     len(h.pool.queue),
+		Backlog:    h.pool.Pending(),
+		Updating:   h.pool.Updating(),
+		Healthy:    true,
+	}
+	fail := func(format string, a ...interface{}) {
+		r.Healthy = false
+		r.Problems = append(r.Problems, fmt.Sprintf(format, a...))
+	}
+	if r.Workers == 0 {
+		fail("no workers running")
+	}
+	if r.Stuck > 0 {
+		fail("%d worker(s) on one job for over %s", r.Stuck, h.MaxBusy)
+	}
+	listedSince := r.LastList
+	if listedSince.IsZero() {
+		listedSince = h.started
+	}
+	if now.Sub(listedSince) > h.MaxListAge {
+		fail("no host list fetched for over %s", h.MaxListAge)
+	}
+	healthy := r.Healthy
+	if r.LastList.IsZero() {
+		fail("no host list fetched yet")
+	}
+	updatedSince := r.LastUpdate
+	if updatedSince.IsZero() {
+		updatedSince = h.started
+	}
+	if r.Updating && r.LastCheck.Sub(updatedSince) > h.MaxUpdateAge {
+		fail("no successful update for over %s", h.MaxUpdateAge)
+	}
+	if r.Backlog > h.MaxBacklog {
+		fail("%d due job(s) waiting for room in the queue", r.Backlog)
+	}
+	r.Ready = r.Healthy
+	r.Healthy = healthy
+	return r
+}
+
+// Serves /healthz and /readyz, answering 503 when unhealthy or unready
+func (h *Health) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		r := h.Report(time.Now())
+		writeHealth(w, r, r.Healthy)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		r := h.Report(time.Now())
+		writeHealth(w, r, r.Ready)
+	})
+}
+
+func writeHealth(w http.ResponseWriter, r *HealthReport, ok bool) {
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(r)
+}
+
+func unixTime(nanos int64) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
@@ -0,0 +1,88 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthReport(t *testing.T) {
+	now := time.Now()
+	for _, tt := range []struct {
+		name    string
+		workers uint8
+		updates bool
+		listed  time.Duration // ago, 0 for never
+		checked time.Duration
+		updated time.Duration
+		busy    time.Duration // the first worker on one job for this long
+		backlog int
+		healthy bool
+		ready   bool
+	}{
+		{name: "running", workers: 2, listed: time.Second, healthy: true, ready: true},
+		{name: "starting", workers: 2, healthy: true},
+		{name: "no workers", listed: time.Second},
+		{name: "list too old", workers: 2, listed: 2 * time.Minute},
+		{name: "worker stuck", workers: 2, listed: time.Second, busy: 3 * time.Minute},
+		{name: "worker busy", workers: 2, listed: time.Second, busy: time.Minute, healthy: true, ready: true},
+		{name: "updates failing", workers: 2, updates: true, listed: time.Second, checked: time.Second, updated: 20 * time.Minute, healthy: true},
+		{name: "updates sent", workers: 2, updates: true, listed: time.Second, checked: time.Second, updated: 2 * time.Second, healthy: true, ready: true},
+		{name: "not updating", workers: 2, listed: time.Second, checked: time.Second, updated: 20 * time.Minute, healthy: true, ready: true},
+		{name: "backed up", workers: 2, listed: time.Second, backlog: 11, healthy: true},
+		{name: "some backlog", workers: 2, listed: time.Second, backlog: 10, healthy: true, ready: true},
+	} {
+		pool := newTestPool(&testSink{}, 1)
+		pool.SetUpdating(tt.updates)
+		pool.size = int(tt.workers) // no goroutines needed to report on
+		for i := 0; i < tt.backlog; i++ {
+			pool.pending = append(pool.pending, &Job{})
+		}
+		if tt.busy > 0 {
+			pool.setBusy(0, now.Add(-tt.busy))
+		}
+		h := NewHealth(pool)
+		h.started = now.Add(-time.Minute + time.Second)
+		h.MaxListAge, h.MaxUpdateAge, h.MaxBusy, h.MaxBacklog = time.Minute, 10*time.Minute, 2*time.Minute, 10
+		if tt.listed > 0 {
+			h.ListFetched(now.Add(-tt.listed))
+		}
+		if tt.checked > 0 {
+			h.Checked(now.Add(-tt.checked))
+		}
+		if tt.updated > 0 {
+			h.Updated(now.Add(-tt.updated))
+		}
+		r := h.Report(now)
+		if r.Healthy != tt.healthy || r.Ready != tt.ready {
+			t.Errorf("%s: healthy %t ready %t (%v), want healthy %t ready %t", tt.name, r.Healthy, r.Ready, r.Problems, tt.healthy, tt.ready)
+		}
+		if !r.Ready && len(r.Problems) == 0 {
+			t.Errorf("%s: not ready without saying why", tt.name)
+		}
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	pool := newTestPool(&testSink{}, 1)
+	pool.size = 1
+	h := NewHealth(pool)
+	h.MaxListAge, h.MaxBacklog = time.Minute, 10
+	mux := http.NewServeMux()
+	h.Register(mux)
+	status := func(path string) int {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		return rec.Code
+	}
+	if healthz, readyz := status("/healthz"), status("/readyz"); healthz != http.StatusOK || readyz != http.StatusServiceUnavailable {
+		t.Errorf("before the first list /healthz = %d, /readyz = %d, want 200 and 503", healthz, readyz)
+	}
+	h.ListFetched(time.Now())
+	if readyz := status("/readyz"); readyz != http.StatusOK {
+		t.Errorf("after a list /readyz = %d, want 200", readyz)
+	}
+}
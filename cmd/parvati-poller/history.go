@@ -0,0 +1,135 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/misatosangel/parvati-soku-checker/pkg/history"
+	"github.com/misatosangel/parvati-soku-checker/pkg/profile"
+	"github.com/misatosangel/soku-net-checker/pkg/checker"
+)
+
+// Opens the check history store if one was configured, returns nil otherwise.
+func OpenHistoryOrDie() *history.Store {
+	if settings.History == "" {
+		return nil
+	}
+	if settings.Replay != "" {
+		historyLog.Warn("Not opening history while replaying, replayed checks are kept out of it", "path", settings.History)
+		return nil
+	}
+	store, err := history.Open(settings.History, history.Options{
+		MaxAge:     settings.HistoryAge,
+		MaxPerHost: settings.HistoryMax,
+	})
+	if err != nil {
+		historyLog.Fatal("Unable to open history", "path", settings.History, "error", err)
+	}
+	return store
+}
+
+// Periodically applies the history retention settings, never returns.
+func CompactHistory(store *history.Store, every time.Duration) {
+	for range time.Tick(every) {
+		removed, err := store.Compact(time.Now())
+		if err != nil {
+			historyLog.Error("Compaction failed", "error", err)
+			continue
+		}
+		historyLog.Debug("Compacted", "removed", removed)
+	}
+}
+
+// What /history/<host id> answers with
+type HistoryReport struct {
+	HostId  int64            `json:"host_id"`
+	Last    *history.Record  `json:"last"`    // most recent check, null if never checked
+	LastUp  *history.Record  `json:"last_up"` // most recent check finding it up, null if never
+	From    time.Time        `json:"from"`
+	To      time.Time        `json:"to"`
+	Records []history.Record `json:"records"` // checks from From to To, oldest first
+}
+
+// Adds /history/<host id> to the mux, answering from the open store as the
+// poller holds the only lock on it. The records listed default to the last
+// day's, ?from= and ?to= take RFC 3339 times. Opponent addresses are never
+// served, as nothing here says who may see them.
+func RegisterHistory(mux *http.ServeMux, store *history.Store) {
+	mux.HandleFunc("/history/", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fail := func(code int, msg string) {
+			w.WriteHeader(code)
+			json.NewEncoder(w).Encode(map[string]string{"error": msg})
+		}
+		id, err := strconv.ParseInt(strings.TrimPrefix(req.URL.Path, "/history/"), 10, 64)
+		if err != nil {
+			fail(http.StatusBadRequest, "Expected /history/<host id>")
+			return
+		}
+		r := HistoryReport{HostId: id, To: time.Now()}
+		r.From = r.To.Add(-24 * time.Hour)
+		for _, q := range []struct {
+			name string
+			t    *time.Time
+		}{{"from", &r.From}, {"to", &r.To}} {
+			if v := req.URL.Query().Get(q.name); v != "" {
+				if *q.t, err = time.Parse(time.RFC3339, v); err != nil {
+					fail(http.StatusBadRequest, "Bad "+q.name+" time: "+err.Error())
+					return
+				}
+			}
+		}
+		if r.Last, err = store.Last(id); err == nil {
+			if r.LastUp, err = store.LastUp(id); err == nil {
+				r.Records, err = store.Range(id, r.From, r.To)
+			}
+		}
+		if err != nil {
+			historyLog.Error("Reading history failed", "host_id", id, "error", err)
+			fail(http.StatusInternalServerError, err.Error())
+			return
+		}
+		r.hideOpponents()
+		json.NewEncoder(w).Encode(&r)
+	})
+}
+
+func (r *HistoryReport) hideOpponents() {
+	for _, rec := range []*history.Record{r.Last, r.LastUp} {
+		if rec != nil {
+			rec.Opponent = ""
+		}
+	}
+	for i := range r.Records {
+		r.Records[i].Opponent = ""
+	}
+}
+
+// Turns a check of a job's host into a history record
+func HistoryRecord(j *Job, result *checker.CheckResult, when time.Time) history.Record {
+	spec := "unknown"
+	switch result.Spectate {
+	case 'y':
+		spec = "yes"
+	case 'n':
+		spec = "no"
+	}
+	return history.Record{
+		HostId:   j.OrigHostStat.Host.BaseInfo.Id,
+		Time:     when,
+		Address:  result.Address,
+		Family:   AddressFamily(result.Address),
+		Status:   result.Status,
+		Up:       result.GoodStatus(),
+		Version:  result.Version,
+		Roll:     result.Additional.Roll,
+		Spectate: spec,
+		Profiles: profile.Names(result.Profiles),
+		Opponent: result.Opponent,
+	}
+}
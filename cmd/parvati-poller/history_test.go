@@ -0,0 +1,58 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-soku-checker/pkg/history"
+)
+
+func TestHistoryHidesOpponents(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := history.Open(filepath.Join(dir, "history.db"), history.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	now := time.Now()
+	for _, status := range []string{"Waiting", "Playing"} {
+		now = now.Add(time.Second)
+		r := history.Record{HostId: 1, Time: now.Add(-time.Minute), Status: status, Up: true, Opponent: "198.51.100.7:10800"}
+		if err := store.Add(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mux := http.NewServeMux()
+	RegisterHistory(mux, store)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/history/1", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("GET /history/1 = %d: %s", rec.Code, rec.Body)
+	}
+	if strings.Contains(rec.Body.String(), "198.51.100.7") {
+		t.Errorf("opponent address served: %s", rec.Body)
+	}
+	var r HistoryReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Last == nil || r.Last.Status != "Playing" || len(r.Records) != 2 {
+		t.Errorf("GET /history/1 = %+v, want both checks", r)
+	}
+	if last, _ := store.Last(1); last == nil || last.Opponent == "" {
+		t.Error("opponent address dropped from the store")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Tracks which jobs are queued or being worked on so the same host (or waiter)
+// is never handed out twice at once.
+type InFlight struct {
+	lock sync.Mutex
+	jobs map[string]bool
+}
+
+func NewInFlight() *InFlight {
+	return &InFlight{jobs: make(map[string]bool)}
+}
+
+// Marks the job as in flight, returns false if it already was.
+func (f *InFlight) Begin(j *Job) bool {
+	key := j.Key()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.jobs[key] {
+		return false
+	}
+	f.jobs[key] = true
+	return true
+}
+
+// Marks the job as finished.
+func (f *InFlight) Done(j *Job) {
+	key := j.Key()
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.jobs, key)
+}
+
+func (f *InFlight) Len() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.jobs)
+}
+
+// Identifies what the job is working on: the address of the host being
+// checked, or the user whose wait is being terminated.
+func (j *Job) Key() string {
+	if j.Request == nil {
+		return fmt.Sprintf("waiter:%d", j.WaitStat.Waiter.User.Id)
+	}
+	return "host:" + j.Request.Address
+}
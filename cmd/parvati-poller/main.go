@@ -9,17 +9,24 @@ package main
 import (
 	"fmt"
 	"github.com/jessevdk/go-flags"
-	"log"
+	"math/rand"
 	"net"
 	"os"
 	"os/signal"
 	"runtime/pprof"
+	"strconv"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
 	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"github.com/misatosangel/parvati-soku-checker/pkg/geoip"
+	"github.com/misatosangel/parvati-soku-checker/pkg/logging"
+	"github.com/misatosangel/parvati-soku-checker/pkg/netguard"
+	"github.com/misatosangel/parvati-soku-checker/pkg/profile"
 	"github.com/misatosangel/soku-net-checker/pkg/checker"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 // Variables used for command line parameters
@@ -29,28 +36,98 @@ var settings struct {
 	ConfigFile string        `short:"c" long:"config" required:"false" value-name:"<path>" description:"Location of a gitconfig style file holding your credentials and password and other preferences."`
 	OneShot    bool          `short:"o" long:"once" description:"Just check once, do not keep checking"`
 	Frequency  time.Duration `short:"f" default:"5s" value-name:"<duration>" long:"frequency" description:"How often to keep checking"`
+	MinWait    time.Duration `long:"min-interval" default:"5s" value-name:"<duration>" description:"Shortest time between checks of the same host, used after its status changes."`
+	MaxWait    time.Duration `long:"max-interval" default:"5m" value-name:"<duration>" description:"Longest time between checks of a host whose status is not changing."`
+	Backoff    float64       `long:"backoff" default:"2" value-name:"<factor>" description:"Multiply a host's check interval by this each time its status is unchanged."`
+	ConfirmUp  int           `long:"confirm-up" default:"1" value-name:"<count>" description:"Consecutive checks needed before reporting a change to an up status."`
+	ConfirmDn  int           `long:"confirm-down" default:"2" value-name:"<count>" description:"Consecutive checks needed before reporting a change to a down status."`
+	Level      string        `long:"check-level" value-name:"<level>" description:"How deep to check hosts by default (basic, state or full), default is as far as reaching the spectator relay with --probe-follow-redirects, otherwise basic."`
+	LevelBy    []string      `long:"check-level-status" value-name:"<status>=<level>" description:"Check hosts listed with this status at a different level, e.g. Down=basic. May be given more than once."`
+	LevelHost  []string      `long:"check-level-host" value-name:"<id>=<level>" description:"Always check the host with this id at the given level. May be given more than once."`
+	FullEvery  int           `long:"full-every" default:"0" value-name:"<count>" description:"Check each host at --full-level every this many checks, 0 for never."`
+	FullLevel  string        `long:"full-level" default:"full" value-name:"<level>" description:"Level used by --full-every."`
+	Heartbeat  time.Duration `long:"heartbeat" default:"5m" value-name:"<duration>" description:"Only update Parvati about a host whose status is unchanged this often, 0 to send every check."`
 	Version    func()        `long:"version" required:"false" description:"Print tool version and exit."`
+	IPFamily   string        `long:"ip-family" default:"prefer4" choice:"prefer4" choice:"prefer6" choice:"4" choice:"6" description:"Which of a host's addresses to check: prefer IPv4 or IPv6 (trying the other if the first is not up) or only one."`
 	Timeout    time.Duration `long:"timeout" default:"1s" value-name:"<duration>" description:"How long to wait for responses, default 1s."`
-	Debug      bool          `short:"d" long:"debug" description:"Lots of verbose info, implies --api-debug."`
+	Retries    int           `long:"retries" default:"3" value-name:"<count>" description:"How many times to try a host that looks down before reporting it as such."`
+	RetryWait  time.Duration `long:"retry-backoff" default:"250ms" value-name:"<duration>" description:"Wait before retrying a host that looks down, doubled for each further retry."`
+	Jitter     time.Duration `long:"retry-jitter" default:"250ms" value-name:"<duration>" description:"Add up to this much random time to each retry wait."`
+	Debug      bool          `short:"d" long:"debug" description:"Log everything at debug level, implies --api-debug."`
 	Updates    bool          `long:"update" description:"Actually commit back updates."`
+	HostsFile  string        `long:"hosts-file" value-name:"<path>" description:"Check the hosts listed in this YAML or JSON file instead of those on Parvati."`
+	Results    string        `long:"results" value-name:"<path>" description:"Write check results to this JSON file ('-' for stdout) instead of updating Parvati. Implies --update."`
+	JSONOut    string        `long:"json" required:"false" value-name:"<path>" description:"Write one JSON object per check to this file ('-' for stdout) instead of the read-only log lines."`
+	Record     string        `long:"record" value-name:"<path>" description:"Append each tick's host list and every check result to this archive file."`
+	Replay     string        `long:"replay" value-name:"<path>" description:"Run the checks in a --record archive again without any network access, then exit. Nothing is sent to Parvati, combine with --json or --results to see what would have been."`
 	APIDebug   bool          `long:"api-debug" description:"Debug API load errors."`
 	Threads    uint8         `short:"t" long:"threads" default:"5" description:"Number of threads to use."`
+	MaxThreads uint8         `long:"max-threads" default:"0" value-name:"<count>" description:"Grow the pool up to this many threads when busy and shrink it when quiet, starting at --threads. 0 keeps it at --threads."`
+	MinThreads uint8         `long:"min-threads" default:"1" value-name:"<count>" description:"Fewest threads to shrink to with --max-threads."`
+	ScaleWait  time.Duration `long:"scale-wait" default:"1s" value-name:"<duration>" description:"With --max-threads, grow the pool when jobs wait in the queue longer than this on average."`
+	ScaleEvery time.Duration `long:"scale-interval" default:"30s" value-name:"<duration>" description:"With --max-threads, how often to reconsider the pool size."`
+	StopWait   time.Duration `long:"shutdown-timeout" default:"10s" value-name:"<duration>" description:"On stopping, how long to keep working through queued jobs before dropping them."`
+	History    string        `long:"history" required:"false" value-name:"<path>" description:"Record every check in a local history database at this path."`
+	HistoryAge time.Duration `long:"history-max-age" default:"720h" value-name:"<duration>" description:"Drop history records older than this, 0 to keep forever."`
+	HistoryMax int           `long:"history-max-per-host" default:"0" value-name:"<count>" description:"Keep at most this many history records per host, 0 for no limit."`
+	HistoryWeb string        `long:"history-http" value-name:"<address>" description:"Serve the check history at /history/<host id> on this address, may be the same as --metrics or --health. Off by default."`
+	Webhooks   []string      `long:"webhook" value-name:"<url>" description:"POST host status changes to this URL, may be given more than once."`
+	HookSecret string        `long:"webhook-secret" value-name:"<secret>" description:"Sign webhook bodies with an HMAC-SHA256 using this secret."`
+	HookFormat string        `long:"webhook-format" default:"json" choice:"json" choice:"discord" description:"Post the raw JSON change or a Discord style message."`
+	HookOn     []string      `long:"webhook-status" value-name:"<status>" description:"Only notify on changes to this status (e.g. Waiting), may be given more than once. Default all."`
+	HookEvery  time.Duration `long:"webhook-interval" default:"5m" value-name:"<duration>" description:"Notify about each host at most this often."`
+	Metrics    string        `long:"metrics" required:"false" value-name:"<address>" description:"Serve prometheus metrics at /metrics on this address (e.g. :9110), off by default."`
+	Health     string        `long:"health" required:"false" value-name:"<address>" description:"Serve /healthz and /readyz on this address, may be the same as --metrics. Off by default."`
+	MaxListAge time.Duration `long:"health-max-list-age" default:"1m" value-name:"<duration>" description:"Unhealthy if the host list has not been fetched for this long."`
+	MaxUpdAge  time.Duration `long:"health-max-update-age" default:"10m" value-name:"<duration>" description:"Not ready if checks are being made but no update has succeeded for this long."`
+	MaxBusy    time.Duration `long:"health-max-job-time" default:"2m" value-name:"<duration>" description:"Unhealthy if a worker has been on one job for this long."`
+	MaxBacklog int           `long:"health-max-backlog" default:"100" value-name:"<count>" description:"Not ready if more than this many due jobs are waiting for room in the queue."`
+	Shards     int           `long:"shards" default:"0" value-name:"<count>" description:"Split hosts between this many poller instances sharing --shard-dir, 0 to poll every host."`
+	ShardIndex int           `long:"shard" default:"0" value-name:"<index>" description:"Which shard (0 to --shards - 1) this instance polls."`
+	ShardDir   string        `long:"shard-dir" value-name:"<path>" description:"Directory shared by all instances, holding each shard's lease."`
+	ShardLease time.Duration `long:"shard-lease" default:"30s" value-name:"<duration>" description:"Take over a shard whose instance has not renewed its lease for this long."`
+
+	Probes  netguard.Options `group:"Probe limits"`
+	GeoIP   geoip.Options    `group:"GeoIP"`
+	Logging logging.Options  `group:"Logging"`
 }
 
+// Loggers for each component, see --log-component
+var (
+	pollerLog  = logging.New("poller")
+	workerLog  = logging.New("worker")
+	parvatiLog = logging.New("parvati")
+	webhookLog = logging.New("webhook")
+	shardLog   = logging.New("shard")
+	historyLog = logging.New("history")
+	httpLog    = logging.New("http")
+	replayLog  = logging.New("replay")
+)
+
 type Job struct {
 	Roll         string
 	Request      *checker.Request
+	Fallback     *checker.Request // other address family to try if Request is not up
 	ToPoint      uint
 	OrigHostStat swagger.HosterStatus
 	WaitStat     swagger.WaiterStatus
 	Game         *swagger.Game
+	Cycle        uint64    // tick the job was queued on, for recording
+	Queued       time.Time // when the job was put on the queue
 }
 
+// Limits where and how fast hosts are probed
+var guard *netguard.Guard
+
+// Where host and opponent addresses are from, nil if not configured
+var geo *geoip.DB
+
 var buildVersion = "dev"
 var buildDate = "dev"
 var buildCommit = "dev"
 
 func init() {
+	rand.Seed(time.Now().UnixNano())
 }
 
 func main() {
@@ -60,98 +137,362 @@ func main() {
 func run() int {
 	// this will fatal or exit on non-zero or help
 	CliParse()
-	api, config, err := LoadParvatiApi()
-	if err != nil {
-		log.Fatalln("Failed to init parvati API:\n" + err.Error())
+	if err := settings.Logging.Apply(); err != nil {
+		pollerLog.Fatal("Bad logging settings", "error", err)
 	}
 	if settings.Debug {
 		settings.APIDebug = true
+		logging.SetLevel(logging.Debug)
+	}
+	g, err := settings.Probes.Guard()
+	if err != nil {
+		pollerLog.Fatal("Bad probe limits", "error", err)
+	}
+	guard = g
+	geo, err = settings.GeoIP.Open()
+	if err != nil {
+		pollerLog.Fatal("Unable to open GeoIP database", "error", err)
+	}
+	defer geo.Close()
+	depth, err := SettingsCheckDepth()
+	if err != nil {
+		pollerLog.Fatal("Bad check level settings", "error", err)
+	}
+	var parvati *ParvatiClient
+	var config *parvatigo.ApiConfig
+	var source HostSource
+	var sink StatusSink
+	soku := &swagger.Game{UrlShortName: "soku"}
+	if settings.Replay == "" && (settings.HostsFile == "" || settings.Results == "") {
+		var api *parvatigo.Api
+		var err error
+		api, config, err = LoadParvatiApi()
+		if err != nil {
+			pollerLog.Fatal("Failed to init parvati API", "error", err)
+		}
+		if settings.APIDebug {
+			api.Verbose = true
+		}
+		soku = FindSokuGameOrDie(api)
+		parvati = NewParvatiClient(api, soku)
+		source, sink = parvati, parvati
+	}
+	tune, err := LoadTunables()
+	if err != nil {
+		pollerLog.Fatal("Failed to read poller settings", "error", err)
+	}
+	if settings.HostsFile != "" {
+		source = &FileSource{Path: settings.HostsFile}
+	}
+	if settings.Results != "" {
+		fileSource, _ := source.(*FileSource)
+		sink = NewFileSink(settings.Results, fileSource)
+	}
+	sched := NewScheduler(settings.MinWait, settings.MaxWait, settings.Backoff)
+	store := OpenHistoryOrDie()
+	if store != nil {
+		defer store.Close()
+		go CompactHistory(store, time.Hour)
 	}
-	if settings.APIDebug {
-		api.Verbose = true
+	debounce := NewDebouncer(settings.ConfirmUp, settings.ConfirmDn)
+	queueLen := int(tune.Threads) + 1
+	if settings.MaxThreads > tune.Threads {
+		queueLen = int(settings.MaxThreads) + 1
 	}
-	soku := FindSokuGameOrDie(api)
-	jobQueue := make(chan *Job, settings.Threads+1)
-	var i uint8
-	for i = 0; i < settings.Threads; i++ {
-		go Worker(api, i, jobQueue)
+	pool := NewPool(sink, sched, debounce, store, queueLen)
+	waits := NewWaitTimers()
+	pool.waits = waits
+	pool.filter = NewUpdateFilter(settings.Heartbeat)
+	pool.depth = depth
+	if settings.Health != "" {
+		pool.health = NewHealth(pool)
+		pool.health.MaxListAge = settings.MaxListAge
+		pool.health.MaxUpdateAge = settings.MaxUpdAge
+		pool.health.MaxBusy = settings.MaxBusy
+		pool.health.MaxBacklog = settings.MaxBacklog
+	}
+	listeners := NewListeners()
+	if settings.Metrics != "" {
+		RegisterMetrics(listeners.Mux(settings.Metrics, "metrics"), pool)
+	}
+	if settings.Health != "" {
+		pool.health.Register(listeners.Mux(settings.Health, "health checks"))
+	}
+	if settings.HistoryWeb != "" {
+		if store == nil {
+			historyLog.Fatal("--history-http needs --history, and is not served while replaying")
+		}
+		RegisterHistory(listeners.Mux(settings.HistoryWeb, "history"), store)
+	}
+	listeners.Serve()
+	pool.SetUpdating(tune.Updates)
+	if settings.JSONOut != "" {
+		var err error
+		pool.events, err = OpenEventWriter(settings.JSONOut)
+		if err != nil {
+			pollerLog.Fatal("Failed to open JSON output", "path", settings.JSONOut, "error", err)
+		}
+		defer pool.events.Close()
+	}
+	if settings.Replay != "" {
+		return ReplayArchive(pool, settings.Replay, soku)
+	}
+	if settings.Record != "" {
+		var err error
+		pool.recorder, err = OpenRecorder(settings.Record)
+		if err != nil {
+			pollerLog.Fatal("Failed to open archive to record to", "path", settings.Record, "error", err)
+		}
+		defer pool.recorder.Close()
+	}
+	if len(settings.Webhooks) > 0 {
+		pool.notifier = NewNotifier(settings.Webhooks, settings.HookSecret, settings.HookFormat == "discord")
+		pool.notifier.Statuses = settings.HookOn
+		pool.notifier.MinInterval = settings.HookEvery
+	}
+	var scaleC <-chan time.Time
+	if settings.MaxThreads > 0 {
+		if settings.MinThreads < 1 || settings.MinThreads > settings.MaxThreads {
+			pollerLog.Fatal("--min-threads must be between 1 and --max-threads", "min", settings.MinThreads, "max", settings.MaxThreads)
+		}
+		if settings.ScaleEvery <= 0 {
+			pollerLog.Fatal("--scale-interval must be positive")
+		}
+		pool.scaler = NewAutoScaler(settings.MinThreads, settings.MaxThreads, settings.ScaleWait, time.Now())
+		tune.Threads = pool.scaler.Clamp(tune.Threads)
+		scaleTicker := time.NewTicker(settings.ScaleEvery)
+		defer scaleTicker.Stop()
+		scaleC = scaleTicker.C
+		pollerLog.Info("Autoscaling pool", "threads", tune.Threads, "min", settings.MinThreads, "max", settings.MaxThreads)
+	}
+	SetTunables(tune)
+	pool.Resize(tune.Threads)
+	var sharder *Sharder
+	if settings.Shards > 0 {
+		if settings.ShardDir == "" {
+			shardLog.Fatal("--shards needs a --shard-dir shared by all instances")
+		}
+		if settings.ShardLease <= 0 {
+			shardLog.Fatal("--shard-lease must be positive")
+		}
+		sharder, err = NewSharder(settings.ShardDir, settings.ShardIndex, settings.Shards, settings.ShardLease)
+		if err != nil {
+			shardLog.Fatal("Unable to start sharding", "error", err)
+		}
+		if err := sharder.Heartbeat(time.Now()); err != nil {
+			shardLog.Fatal("Unable to write lease", "shard", settings.ShardIndex, "error", err)
+		}
+		sharder.KeepAlive(settings.ShardLease / 3)
 	}
 
 	signalC := make(chan os.Signal, 1)
-	signal.Notify(signalC, os.Interrupt)
+	signal.Notify(signalC, os.Interrupt, syscall.SIGTERM)
 	signalUSR1 := make(chan os.Signal, 1)
 	signal.Notify(signalUSR1, syscall.SIGUSR1)
-	checkTicket := time.NewTicker(settings.Frequency)
-	defer close(jobQueue)
-	log.Printf("Connecting (announce: %s) to %s\n", config.Announcer, api.Info())
+	signalHUP := make(chan os.Signal, 1)
+	signal.Notify(signalHUP, syscall.SIGHUP)
+	checkTicket := time.NewTicker(tune.Frequency)
+	waitTimer := time.NewTimer(time.Hour)
+	waitTimer.Stop()
+	var cycle uint64 // host list fetches so far
+	// ends the waits which have run out and sets the timer for the next
+	queueExpiredWaits := func() int {
+		now := time.Now()
+		queued := 0
+		for _, waiterStatus := range waits.Expired(now) {
+			job := &Job{
+				WaitStat: waiterStatus,
+				Game:     soku,
+				Cycle:    cycle,
+			}
+			if pool.Enqueue(job) != QueuedInFlight {
+				queued++
+			}
+		}
+		if !waitTimer.Stop() {
+			select {
+			case <-waitTimer.C:
+			default:
+			}
+		}
+		if next, ok := waits.Next(); ok {
+			waitTimer.Reset(next.Sub(now))
+		}
+		return queued
+	}
+	// stops once queued jobs are done or the timeout passes, 0 for no limit
+	stop := func(timeout time.Duration) int {
+		checkTicket.Stop()
+		go func() {
+			sig := <-signalC
+			pollerLog.Fatal("Stopping immediately on second signal", "signal", sig)
+		}()
+		if sharder != nil {
+			if err := sharder.Release(); err != nil {
+				shardLog.Error("Unable to release lease", "shard", settings.ShardIndex, "error", err)
+			}
+		}
+		pool.Shutdown(timeout)
+		pool.notifier.Close(timeout)
+		pool.LogSummary()
+		return 0
+	}
+	if parvati != nil {
+		pollerLog.Info("Connecting", "parvati", parvati, "announce", config.Announcer)
+	}
+	if source != parvati {
+		pollerLog.Info("Checking hosts", "source", source)
+	}
 	if !settings.OneShot {
-		log.Printf("Starting continuous checker, pid: %d, use CTRL+C to stop or end USR1 for thread-dump.\n", os.Getpid())
+		pollerLog.Info("Starting continuous checker, use CTRL+C or TERM to stop, HUP to reload settings or send USR1 for thread-dump", "pid", os.Getpid())
 	}
-	if !settings.Updates {
-		log.Printf("! Running in read-only mode, will not update.\n")
+	if !tune.Updates {
+		pollerLog.Warn("Running in read-only mode, will not update")
 	}
 	for {
 		select {
 		case <-checkTicket.C:
-			if settings.Debug {
-				log.Printf("Grabbing current hostlist\n")
-			}
-			list, err := api.CheckListedHosts(soku, nil)
+			pollerLog.Debug("Grabbing current hostlist")
+			fetchStart := time.Now()
+			list, err := source.ListHosts()
+			listFetchDuration.Observe(time.Since(fetchStart).Seconds())
 			if err != nil {
+				listFetches.WithLabelValues("error").Inc()
 				if settings.OneShot {
-					log.Fatalln("Failed to get game list:\n" + err.Error())
+					pollerLog.Fatal("Failed to get game list", "error", err)
 				}
-				log.Printf("Failed to get game list:\n" + err.Error())
+				pollerLog.Error("Failed to get game list", "error", err)
 				continue
 			}
-			if settings.Debug {
-				cnt := len(list.Hosts)
-				log.Printf("Found %d active hoster(s)\n", cnt)
+			listFetches.WithLabelValues("ok").Inc()
+			pool.health.ListFetched(time.Now())
+			pollerLog.Debug("Found active hosters", "hosts", len(list.Hosts))
+			if sharder != nil {
+				list = shardList(sharder, list)
+			}
+			cycle++
+			pool.recorder.List(cycle, fetchStart, list)
+			sched.Prune(list.Hosts)
+			debounce.Prune(list.Hosts)
+			pool.filter.Prune(list.Hosts)
+			depth.Prune(list.Hosts)
+			pool.notifier.Prune(list.Hosts)
+			now := time.Now()
+			skipped := 0
+			var queued, busy, pending int
+			enqueue := func(job *Job) {
+				// never blocks the main loop, whatever doesn't fit is held by the pool
+				switch pool.Enqueue(job) {
+				case QueuedOK:
+					queued++
+				case QueuedInFlight:
+					busy++
+				case QueuedPending:
+					pending++
+				}
 			}
 			for _, hosterStatus := range list.Hosts {
-				req, err := HostToCheckReq(&hosterStatus.Host)
+				if !sched.Due(&hosterStatus, now) {
+					skipped++
+					continue
+				}
+				req, fallback, err := HostToCheckReq(&hosterStatus.Host)
 				if err != nil {
-					log.Printf("Could not parse IP from host: %s", err.Error())
+					pollerLog.Warn("Could not parse IP from host", "host_id", hosterStatus.Host.BaseInfo.Id, "error", err)
 					continue
 				}
 				job := &Job{
 					Roll:         hosterStatus.Host.Version,
 					Request:      req,
-					ToPoint:      checker.STATE_SPEC_REACH_RELAY,
+					Fallback:     fallback,
 					OrigHostStat: hosterStatus,
 					Game:         soku,
+					Cycle:        cycle,
 				}
-				jobQueue <- job
+				enqueue(job)
 			}
-			cnt := len(list.Waits)
-			if settings.Debug {
-				log.Printf("Found %d active waiter(s)\n", cnt)
+			if skipped > 0 {
+				pollerLog.Debug("Skipped hosters not yet due a check", "skipped", skipped)
 			}
-			if cnt > 0 {
-				now := time.Now().UTC()
-				for _, waiterStatus := range list.Waits {
-					wExpire := waiterStatus.Waiter.WaitUntil.UTC()
-					if wExpire.Before(now) {
-						job := &Job{
-							WaitStat: waiterStatus,
-							Game:     soku,
-						}
-						jobQueue <- job
-					}
-				}
+			pollerLog.Debug("Found active waiters", "waiters", len(list.Waits))
+			waits.Sync(list.Waits)
+			queued += queueExpiredWaits()
+			if busy > 0 || pending > 0 {
+				pollerLog.Info("Queued jobs", "queued", queued, "in_flight", busy, "pending", pending, "backlog", pool.Pending())
+			} else {
+				pollerLog.Debug("Queued jobs", "queued", queued)
 			}
 			if settings.OneShot {
-				return 0
+				return stop(0) // every listed host gets checked
+			}
+		case <-scaleC:
+			size := pool.Size()
+			target, sample := pool.scaler.Target(size, pool.Pending(), time.Now())
+			slog := pollerLog.With("threads", target, "was", size, "jobs", sample.Jobs, "avg_wait", sample.Wait, "avg_check", sample.Took, "busy", fmt.Sprintf("%.1f", sample.Busy), "backlog", sample.Backlog)
+			if target == size {
+				slog.Debug("Pool size unchanged")
+				break
+			}
+			slog.Info("Resizing pool")
+			pool.Resize(uint8(target))
+		case <-waitTimer.C:
+			queued := queueExpiredWaits()
+			if queued > 0 {
+				pollerLog.Debug("Queued expired waits", "queued", queued)
+			}
+		case <-signalHUP:
+			pollerLog.Info("Reloading configuration on SIGHUP")
+			old := CurrentTunables()
+			tune, err := LoadTunables()
+			if err != nil {
+				pollerLog.Error("Failed to reload poller settings", "error", err)
+				break
 			}
+			tune.Threads = pool.scaler.Clamp(tune.Threads)
+			SetTunables(tune)
+			if tune.Frequency != old.Frequency {
+				pollerLog.Info("Check frequency changed", "frequency", tune.Frequency, "was", old.Frequency)
+				checkTicket.Stop()
+				checkTicket = time.NewTicker(tune.Frequency)
+			}
+			if tune.Threads != old.Threads {
+				pollerLog.Info("Resizing pool", "threads", tune.Threads, "was", old.Threads)
+				pool.Resize(tune.Threads)
+				pool.scaler.Reset(time.Now()) // scale on from the new size
+			}
+			if tune.Updates != old.Updates {
+				pollerLog.Info("Updates to Parvati changed", "enabled", tune.Updates)
+				pool.SetUpdating(tune.Updates)
+			}
+			if parvati == nil {
+				break
+			}
+			newConfig, err := LoadParvatiConfig()
+			if err != nil {
+				parvatiLog.Error("Failed to reload credentials, keeping existing", "error", err)
+				break
+			}
+			if newConfig.URI == config.URI && newConfig.Username == config.Username && newConfig.Password == config.Password {
+				break
+			}
+			newApi, err := parvatigo.NewApi(newConfig, buildVersion)
+			if err != nil {
+				parvatiLog.Error("Failed to re-authenticate with new credentials, keeping existing", "error", err)
+				break
+			}
+			newApi.Verbose = settings.APIDebug
+			config = newConfig
+			parvati.SetApi(&newApi)
+			parvatiLog.Info("Credentials changed", "parvati", parvati)
 		case sig := <-signalUSR1:
-			log.Printf("=== received " + sig.String() + " ===\n*** blocking goroutine dump ***\n")
+			pollerLog.Info("Blocking goroutine dump", "signal", sig)
 			pprof.Lookup("block").WriteTo(os.Stderr, 1)
-			log.Printf("*** full goroutine dump ***\n")
+			pollerLog.Info("Full goroutine dump", "signal", sig)
 			pprof.Lookup("goroutine").WriteTo(os.Stderr, 1)
-			log.Printf("*** end full goroutine dump ***\n")
+			pollerLog.Info("End full goroutine dump", "signal", sig)
 		case sig := <-signalC:
-			fmt.Println("Stopping on signal:", sig)
-			return 0
+			pollerLog.Info("Stopping on signal", "signal", sig)
+			return stop(settings.StopWait)
 		}
 	}
 
@@ -161,130 +502,307 @@ func run() int {
 
 // Create a check request form the given host information
 // Match up roll version
-func HostToCheckReq(host *swagger.Host) (*checker.Request, error) {
-	hostAddr := host.Ipv4 // we know soku can only IPv4 but just in case
-	if hostAddr == "" {
-		hostAddr := host.Ipv6
+// Addresses are picked according to --ip-family, if the host has addresses
+// in both families and both may be used the other is returned as a fallback.
+func HostToCheckReq(host *swagger.Host) (*checker.Request, *checker.Request, error) {
+	var addrs []string
+	switch settings.IPFamily {
+	case "4":
+		addrs = []string{host.Ipv4}
+	case "6":
+		addrs = []string{host.Ipv6}
+	case "prefer6":
+		addrs = []string{host.Ipv6, host.Ipv4}
+	default: // prefer4
+		addrs = []string{host.Ipv4, host.Ipv6}
+	}
+	var reqs []*checker.Request
+	for _, hostAddr := range addrs {
 		if hostAddr == "" {
-			return nil, fmt.Errorf("Host id %d (name: %s) has no IPv4 or v6 address", host.BaseInfo.Id, host.BaseInfo.DisplayName)
+			continue
 		}
+		pollerLog.Debug("Host address", "host_id", host.BaseInfo.Id, "name", host.BaseInfo.DisplayName, "address", hostAddr)
+		addr := net.JoinHostPort(hostAddr, fmt.Sprintf("%d", host.Port))
+		req, err := checker.NewRequest(addr)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := guard.Permitted(req.Address); err != nil {
+			pollerLog.Debug("Not checking host address", "host_id", host.BaseInfo.Id, "name", host.BaseInfo.DisplayName, "address", req.Address, "error", err)
+			continue
+		}
+		req.Timeout = CurrentTunables().Timeout
+		reqs = append(reqs, req)
 	}
-	if settings.Debug {
-		log.Printf("Host id %d (name: %s) has Address: %s", host.BaseInfo.Id, host.BaseInfo.DisplayName, hostAddr)
+	switch len(reqs) {
+	case 0:
+		return nil, nil, fmt.Errorf("Host id %d (name: %s) has no usable address for IP family %s", host.BaseInfo.Id, host.BaseInfo.DisplayName, settings.IPFamily)
+	case 1:
+		return reqs[0], nil, nil
 	}
-	addr := net.JoinHostPort(hostAddr, fmt.Sprintf("%d", host.Port))
-	req, err := checker.NewRequest(addr)
+	return reqs[0], reqs[1], nil
+}
+
+// "ipv4" or "ipv6" for a host:port address, "" if it is not an IP
+func AddressFamily(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, err
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return ""
 	}
-	req.Timeout = settings.Timeout
-	return req, nil
+	if ip.To4() != nil {
+		return "ipv4"
+	}
+	return "ipv6"
 }
 
 func FindSokuGameOrDie(api *parvatigo.Api) *swagger.Game {
+	game, err := FindSokuGame(api)
+	if err != nil {
+		parvatiLog.Fatal("Unable to find the soku game", "error", err)
+	}
+	return game
+}
+
+// Looks up soku among the games Parvati supports
+func FindSokuGame(api *parvatigo.Api) (*swagger.Game, error) {
 	games, err := api.GetGames()
 	if err != nil {
-		log.Fatalln("Failed to get game list:\n" + err.Error())
+		return nil, fmt.Errorf("Failed to get game list: %s", err.Error())
 	}
 	for _, game := range games {
 		if game.UrlShortName == "soku" {
-			return &game
+			return &game, nil
 		}
 	}
-	failMsg := "Failed to find soku in supported games list, found:\n"
+	var found []string
 	for _, game := range games {
-		failMsg += game.UrlShortName + "\n"
+		found = append(found, game.UrlShortName)
 	}
-	log.Fatalln("Failed to get game list:\n" + err.Error())
-	return nil // can't get here anyway
+	return nil, fmt.Errorf("Failed to find soku in supported games list, found %v", found)
 }
 
 // Main worker loops
 // Spawn worker thread, listen on the queue until a null job comes through or the queue closes
-func Worker(api *parvatigo.Api, tid uint8, queue chan *Job) {
-
-	for j := range queue {
-		if j == nil {
+// Once the pool is cancelled any remaining queued jobs are dropped.
+// Workers also stop one at a time when the pool is shrunk.
+func (p *Pool) Worker(tid uint8) {
+	defer p.workers.Done()
+	defer atomic.AddInt32(&p.live, -1)
+	defer p.releaseTid(tid)
+	latency := checkDuration.WithLabelValues(strconv.Itoa(int(tid)))
+	for {
+		var j *Job
+		var ok bool
+		select {
+		case <-p.shrink:
+			workerLog.Debug("Stopping, pool shrunk", "thread", tid)
 			return
+		case j, ok = <-p.queue:
 		}
-		if j.Request == nil {
-			// a waiter
-			if !settings.Updates {
-				log.Printf("Thread: %d [NOT UPDATING] terminating wait by: '%s' (%d)", tid, j.WaitStat.Waiter.DisplayName, j.WaitStat.Waiter.User.Id)
-				continue
-			}
-			if settings.Debug {
-				log.Printf("Thread: %d terminating wait by: '%s' (%d)", tid, j.WaitStat.Waiter.DisplayName, j.WaitStat.Waiter.User.Id)
+		if ok {
+			p.refill() // the place just taken
+		} else {
+			// shutting down, but pending jobs still need working through
+			if j = p.popPending(); j == nil {
+				return
 			}
-			apiErr := api.UpdateWaitTime(j.Game, j.WaitStat.Waiter.User.Id, 0, "")
-			if apiErr != nil {
-				log.Printf("Thread: %d terminating wait by: '%s' (%d) failed: %s", tid, j.WaitStat.Waiter.DisplayName, j.WaitStat.Waiter.User.Id, apiErr.Error())
+		}
+		select {
+		case <-p.cancel:
+			atomic.AddUint64(&p.Stats.Dropped, 1)
+		default:
+			start := time.Now()
+			wait := start.Sub(j.Queued)
+			queueWait.Observe(wait.Seconds())
+			p.setBusy(tid, start)
+			p.RunJob(tid, latency, j)
+			p.setBusy(tid, time.Time{})
+			p.scaler.Observe(wait, time.Since(start))
+		}
+		p.inFlight.Done(j)
+	}
+}
+
+// Writes out the event if JSON output is on
+func (p *Pool) writeEvent(ev *CheckEvent) {
+	if p.events == nil {
+		return
+	}
+	err := p.events.Write(ev)
+	if err != nil {
+		workerLog.Error("Writing JSON output failed", "thread", ev.Thread, "host_id", ev.HostId, "error", err)
+	}
+}
+
+// Carries out a single job for the given worker thread
+func (p *Pool) RunJob(tid uint8, latency prometheus.Observer, j *Job) {
+	updating := p.Updating()
+	if j.Request == nil {
+		// a waiter
+		wlog := workerLog.With("thread", tid, "user_id", j.WaitStat.Waiter.User.Id, "waiter", j.WaitStat.Waiter.DisplayName)
+		p.recorder.Wait(j, time.Now())
+		if !updating {
+			wlog.Info("[NOT UPDATING] terminating wait")
+			return
+		}
+		wlog.Debug("Terminating wait")
+		apiErr := p.sink.EndWait(j)
+		if apiErr == nil {
+			atomic.AddUint64(&p.Stats.WaitsEnded, 1)
+			p.health.Updated(time.Now())
+		} else {
+			atomic.AddUint64(&p.Stats.UpdateErrors, 1)
+			updateErrors.WithLabelValues("wait_time").Inc()
+			wlog.Error("Terminating wait failed", "error", apiErr)
+			if p.waits != nil {
+				p.waits.Retry(j.WaitStat, time.Now().Add(CurrentTunables().Frequency))
 			}
-			continue
 		}
-		su, err := CheckHost(j)
+		return
+	}
+	hlog := workerLog.With("thread", tid, "host_id", j.OrigHostStat.Host.BaseInfo.Id, "address", j.Request.Address)
+	if loc := geo.Lookup(j.Request.Address); loc != nil {
+		hlog = hlog.With("country", loc.Country, "asn", loc.ASN)
+	}
+	if p.depth != nil {
+		j.ToPoint = p.depth.Level(&j.OrigHostStat)
+	}
+	checkStart := time.Now()
+	su, result, err := p.check(j)
+	p.health.Checked(time.Now())
+	took := time.Since(checkStart)
+	latency.Observe(took.Seconds())
+	atomic.AddUint64(&p.Stats.Checks, 1)
+	ev := &CheckEvent{
+		Time:     checkStart,
+		Thread:   tid,
+		HostId:   j.OrigHostStat.Host.BaseInfo.Id,
+		Address:  j.Request.Address,
+		Level:    j.ToPoint,
+		Previous: j.OrigHostStat.Status.Status,
+		Update:   su,
+		Duration: took,
+	}
+	if result != nil {
+		ev.Family = AddressFamily(result.Address)
+		ev.Game = result.CurGame
+		ev.HostGeo = geo.Lookup(result.Address)
+		ev.OppGeo = geo.Lookup(result.Opponent)
+	}
+	if err != nil {
+		atomic.AddUint64(&p.Stats.CheckFailures, 1)
+		hostChecks.WithLabelValues("error").Inc()
+		hlog.Error("Checking host failed", "error", err)
+		p.recorder.Failed(j, err, checkStart)
+		ev.Error = err.Error()
+		p.writeEvent(ev)
+		return
+	}
+	hostChecks.WithLabelValues(su.Status).Inc()
+	p.recorder.Check(j, result, checkStart)
+	if p.store != nil {
+		err = p.store.Add(HistoryRecord(j, result, su.CheckDate))
 		if err != nil {
-			log.Printf("Thread: %d checking on host: '%s' failed: %s", tid, j.Request.Address, err.Error())
-			if su != nil {
+			hlog.Error("Recording history failed", "error", err)
+		}
+	}
+	wait := p.sched.Record(&j.OrigHostStat, su.Status, j.Queued)
+	hlog.Debug("Checked host", "status", su.Status, "was", j.OrigHostStat.Status.Status, "answered", result.Address, "next_check", wait)
+	decision := p.debounce.Observe(&j.OrigHostStat, su.Status, result.GoodStatus())
+	ev.Status = su.Status
+	ev.Report = decision.Report
+	p.writeEvent(ev)
+	if !decision.Report {
+		hlog.Debug("Status change pending", "status", su.Status, "seen", decision.Seen, "need", decision.Need)
+		return
+	}
+	if decision.Changed && p.notifier != nil {
+		p.notifier.Notify(j, decision.From, su)
+	}
+	if !updating && p.events != nil {
+		return // already written out
+	}
+	if !updating {
+		spec := "unknown"
+		if su.CanSpec != nil {
+			if *su.CanSpec {
+				spec = "yes"
+			} else {
+				spec = "no"
 			}
-			continue
 		}
-		if settings.Debug {
-			log.Printf("Thread: %d check on host '%s' resulted in status: %s (was: %s)", tid, j.Request.Address, su.Status, j.OrigHostStat.Status.Status)
+		vers := "unknown"
+		if su.NewVers != nil {
+			vers = *su.NewVers
 		}
-		if !settings.Updates {
-			spec := "unknown"
-			if su.CanSpec != nil {
-				if *su.CanSpec {
-					spec = "yes"
-				} else {
-					spec = "no"
-				}
-			}
-			vers := "unknown"
-			if su.NewVers != nil {
-				vers = *su.NewVers
-			}
-			p1name := "(none)"
-			p2name := "(none)"
-			if su.Prof1Name != nil {
-				p1name = *su.Prof1Name
-			}
-			if su.Prof2Name != nil {
-				p2name = *su.Prof2Name
-			}
-
-			log.Printf("Thread: %d [NOT UPDATING] check on host '%s' resulted in status: %s (was: %s). Opponent Addr: %s, Spec: %s. Roll-Vers: %s. Prof1: %s Prof2: %s", tid, j.Request.Address, su.Status, j.OrigHostStat.Status.Status, su.OpponentAddr, spec, vers, p1name, p2name)
-			continue
+		p1name := "(none)"
+		p2name := "(none)"
+		if su.Prof1Name != nil {
+			p1name = *su.Prof1Name
 		}
-		ret, apiErr := api.UpdateHostStatus(j.Game, *su)
-		if apiErr != nil {
-			log.Printf("Thread: %d update host status for '%s' failed: %s", tid, j.Request.Address, apiErr.Error())
-			continue
+		if su.Prof2Name != nil {
+			p2name = *su.Prof2Name
 		}
-		if settings.Debug {
-			log.Printf("Thread: %d check on host '%s' resulted in check id %d status: %s (was: %s). Spec: %s. Roll-Vers: %s. Prof1: %s Prof2: %s\n", tid, j.Request.Address, ret.Id, ret.Status, j.OrigHostStat.Status.Status, ret.CanSpec, ret.Version, ret.P1Profile, ret.P2Profile)
+
+		olog := hlog
+		if loc := geo.Lookup(su.OpponentAddr); loc != nil {
+			olog = hlog.With("opponent_country", loc.Country, "opponent_asn", loc.ASN)
 		}
+		olog.Info("[NOT UPDATING] checked host", "status", su.Status, "was", j.OrigHostStat.Status.Status, "opponent", su.OpponentAddr, "spectate", spec, "version", vers, "profile1", p1name, "profile2", p2name)
+		return
+	}
+	if !p.filter.Wanted(&j.OrigHostStat, su, time.Now()) {
+		atomic.AddUint64(&p.Stats.Unchanged, 1)
+		unchangedUpdates.Inc()
+		hlog.Debug("Host unchanged, not updating")
+		return
+	}
+	apiErr := p.sink.UpdateHostStatus(j, su)
+	if apiErr == nil {
+		atomic.AddUint64(&p.Stats.Updates, 1)
+		p.filter.Sent(&j.OrigHostStat, su, time.Now())
+		p.health.Updated(time.Now())
+	} else {
+		atomic.AddUint64(&p.Stats.UpdateErrors, 1)
+		updateErrors.WithLabelValues("host_status").Inc()
+		hlog.Error("Updating host status failed", "error", apiErr)
 	}
 }
 
+// Checks a job's host, see CheckHost
+type CheckFunc func(j *Job) (*parvatigo.StatusUpdate, *checker.CheckResult, error)
+
 // Attempts to check the host and turn it into a parvati host update structure
-func CheckHost(j *Job) (*parvatigo.StatusUpdate, error) {
-	request, err := checker.NewRequest(j.Request.Address)
-	if err != nil {
-		return nil, err
+// The raw check result is also returned, its address showing which address
+// (and so family) answered.
+// A host which does not look up is retried according to the retry policy,
+// then checked on its fallback address if it has one.
+func CheckHost(j *Job) (*parvatigo.StatusUpdate, *checker.CheckResult, error) {
+	if j.Request == nil {
+		return nil, nil, fmt.Errorf("Job has no check request")
 	}
-	var result checker.CheckResult
-	if j.Roll == "" || j.Roll == "unknown" {
-		result = request.Check(j.ToPoint, false)
-	} else {
-		result = request.CheckVersion(j.ToPoint, j.Roll, false)
+	result, err := checkWithRetries(j, j.Request)
+	if err != nil {
+		return nil, nil, err
 	}
-	if settings.Debug {
-		log.Printf("Result: %s", result.String())
+	if !result.GoodStatus() && j.Fallback != nil {
+		workerLog.Debug("Host not up, trying fallback", "host_id", j.OrigHostStat.Host.BaseInfo.Id, "address", j.Request.Address, "fallback", j.Fallback.Address)
+		fallback, err := checkWithRetries(j, j.Fallback)
+		if err == nil && fallback.GoodStatus() {
+			result = fallback
+		}
 	}
+	return StatusFromResult(j, &result, time.Now()), &result, nil
+}
+
+// Turns a check result into a parvati host update structure
+func StatusFromResult(j *Job, result *checker.CheckResult, when time.Time) *parvatigo.StatusUpdate {
 	su := &parvatigo.StatusUpdate{
-		CheckDate:   time.Now(),
+		CheckDate:   when,
 		Status:      result.Status,
 		HosterId:    j.OrigHostStat.Host.BaseInfo.Id,
 		LastCheckId: j.OrigHostStat.Status.Id,
@@ -302,45 +820,99 @@ func CheckHost(j *Job) (*parvatigo.StatusUpdate, error) {
 			su.CanSpec = &s
 		}
 	}
-	if len(result.Profiles) > 0 {
-		p1 := result.Profiles[0]
-		p2 := result.Profiles[1]
-		if p1 != "" {
-			su.Prof1Name = &p1
-		}
-		if p2 != "" {
-			su.Prof2Name = &p2
-		}
+	names := profile.Names(result.Profiles)
+	if len(names) > 0 && names[0] != "" {
+		su.Prof1Name = &names[0]
+	}
+	if len(names) > 1 && names[1] != "" {
+		su.Prof2Name = &names[1]
 	}
 	if result.Opponent != "" {
 		su.OpponentAddr = result.Opponent
 	}
-	return su, nil
+	return su
+}
+
+// The host then client profile names in an update, "" for one not known and
+// nil if neither is
+func UpdateProfiles(su *parvatigo.StatusUpdate) []string {
+	if su.Prof1Name == nil && su.Prof2Name == nil {
+		return nil
+	}
+	profiles := make([]string, 2)
+	if su.Prof1Name != nil {
+		profiles[0] = *su.Prof1Name
+	}
+	if su.Prof2Name != nil {
+		profiles[1] = *su.Prof2Name
+	}
+	return profiles
+}
+
+// Checks the job's host at the given request's address, retrying while it
+// does not look up. Each attempt waits its turn under the probe rate limits,
+// giving up if that takes longer than the check frequency.
+func checkWithRetries(j *Job, request *checker.Request) (checker.CheckResult, error) {
+	policy := SettingsRetryPolicy()
+	var result checker.CheckResult
+	if j.ToPoint > checker.STATE_BASIC {
+		if err := guard.Redirects(); err != nil {
+			return result, fmt.Errorf("Not checking '%s': %s", request.Address, err.Error())
+		}
+	}
+	for attempt := 1; ; attempt++ {
+		if err := guard.Wait(request.Address, CurrentTunables().Frequency); err != nil {
+			return result, fmt.Errorf("Not checking '%s': %s", request.Address, err.Error())
+		}
+		if j.Roll == "" || j.Roll == "unknown" {
+			result = request.Check(j.ToPoint, false)
+		} else {
+			result = request.CheckVersion(j.ToPoint, j.Roll, false)
+		}
+		workerLog.Debug("Check result", "host_id", j.OrigHostStat.Host.BaseInfo.Id, "address", request.Address, "attempt", attempt, "result", result.String())
+		if result.GoodStatus() || attempt >= policy.Attempts {
+			return result, nil
+		}
+		time.Sleep(policy.Delay(attempt))
+	}
 }
 
 func LoadParvatiApi() (*parvatigo.Api, *parvatigo.ApiConfig, error) {
+	config, err := LoadParvatiConfig()
+	if err != nil {
+		return nil, config, err
+	}
+	api, err := parvatigo.NewApi(config, buildVersion)
+	if err != nil {
+		return nil, config, err
+	}
+	return &api, config, err
+}
+
+// Reads the Parvati credentials from the config file, applying command line overrides
+func LoadParvatiConfig() (*parvatigo.ApiConfig, error) {
 	var config *parvatigo.ApiConfig
 	if settings.ConfigFile == "" {
 		var err error
 		config, err = parvatigo.ReadDefaultConfig()
 		if err != nil {
 			if !os.IsNotExist(err) {
-				return nil, nil, err
+				return nil, err
 			}
 			// no config and no parvati credentials, so just do default list show and leave
 			def, _ := parvatigo.DefaultConfigFile()
-			return nil, nil, fmt.Errorf("No default config file (expected: %s), and no config file given with --config / -c\n"+
+			return nil, fmt.Errorf("No default config file (expected: %s), and no config file given with --config / -c\n"+
 				"You must supply a standard gitconfig style file containing at least a value for parvatigo.password\n", def)
 		}
 	} else {
 		var err error
 		config, err = parvatigo.ReadConfig(settings.ConfigFile)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 	}
 	if config != nil && config.Password == "" {
-		return nil, config, fmt.Errorf("Configuration file did not specify a password with key parvatigo.password\n")
+		return config, fmt.Errorf("Configuration file did not specify a password with key parvatigo.password\n")
 	}
 	if settings.URI != "" {
 		config.URI = settings.URI
@@ -348,11 +920,7 @@ func LoadParvatiApi() (*parvatigo.Api, *parvatigo.ApiConfig, error) {
 	if settings.Username != "" {
 		config.Username = settings.Username
 	}
-	api, err := parvatigo.NewApi(config, buildVersion)
-	if err != nil {
-		return nil, config, err
-	}
-	return &api, config, err
+	return config, nil
 }
 
 func CliParse() {
@@ -371,6 +939,7 @@ func CliParse() {
 				os.Exit(0)
 			}
 		}
-		log.Fatalln(err)
+		pollerLog.Fatal("Bad command line", "error", err)
 	}
+	captureCliTunables(parser)
 }
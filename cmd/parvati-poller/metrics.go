@@ -0,0 +1,142 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "parvati_poller"
+
+var (
+	listFetches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "list_fetches_total",
+		Help:      "Number of CheckListedHosts calls made to Parvati, by result.",
+	}, []string{"result"})
+
+	listFetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "list_fetch_duration_seconds",
+		Help:      "Time taken to fetch the host list from Parvati.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	hostChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "host_checks_total",
+		Help:      "Number of CheckHost calls, by resulting status ('error' if the check itself failed).",
+	}, []string{"status"})
+
+	checkDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "check_duration_seconds",
+		Help:      "Time taken to check a single host, by worker thread.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"thread"})
+
+	queueWait = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_queue_wait_seconds",
+		Help:      "Time jobs spent in the queue before a worker picked them up.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	skippedChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "skipped_jobs_total",
+		Help:      "Number of jobs not queued because they were still in flight, by reason.",
+	}, []string{"reason"})
+
+	updateErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "update_errors_total",
+		Help:      "Number of failed updates sent to Parvati, by call (host_status or wait_time).",
+	}, []string{"call"})
+
+	unchangedUpdates = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unchanged_updates_total",
+		Help:      "Number of host status updates not sent as nothing changed since the last one.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(listFetches, listFetchDuration, hostChecks, checkDuration, queueWait, skippedChecks, updateErrors, unchangedUpdates)
+}
+
+// Adds /metrics to the mux.
+// The depth of the pool's job queue, its backlog and its size are exported
+// as gauges.
+func RegisterMetrics(mux *http.ServeMux, pool *Pool) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_queue_depth",
+		Help:      "Number of jobs waiting in the queue for a worker.",
+	}, func() float64 {
+		return float64(len(pool.queue))
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_backlog",
+		Help:      "Number of due jobs waiting for room in the queue.",
+	}, func() float64 {
+		return float64(pool.Pending())
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "worker_threads",
+		Help:      "Number of worker threads in the pool.",
+	}, func() float64 {
+		return float64(pool.Size())
+	}))
+
+	mux.Handle("/metrics", promhttp.Handler())
+}
+
+// The HTTP listeners to start, with everything asked to be served on the
+// same address sharing one
+type Listeners struct {
+	muxes map[string]*http.ServeMux
+	what  map[string][]string
+	order []string
+}
+
+func NewListeners() *Listeners {
+	return &Listeners{muxes: make(map[string]*http.ServeMux), what: make(map[string][]string)}
+}
+
+// The mux for the given address, what is served is only used for logging
+func (l *Listeners) Mux(addr string, what string) *http.ServeMux {
+	mux, ok := l.muxes[addr]
+	if !ok {
+		mux = http.NewServeMux()
+		l.muxes[addr] = mux
+		l.order = append(l.order, addr)
+	}
+	l.what[addr] = append(l.what[addr], what)
+	return mux
+}
+
+// Serves every address in the background
+func (l *Listeners) Serve() {
+	for _, addr := range l.order {
+		ServeInBackground(strings.Join(l.what[addr], ", "), addr, l.muxes[addr])
+	}
+}
+
+// Serves the mux on the given address in the background, what is served is
+// only used for logging
+func ServeInBackground(what string, addr string, mux *http.ServeMux) {
+	go func() {
+		httpLog.Info("Serving "+what, "address", addr)
+		err := http.ListenAndServe(addr, mux)
+		if err != nil {
+			httpLog.Error("Listener for "+what+" stopped", "address", addr, "error", err)
+		}
+	}()
+}
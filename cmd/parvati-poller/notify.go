@@ -0,0 +1,310 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// Header holding the hex HMAC-SHA256 of the request body, keyed by the webhook secret
+const SignatureHeader = "X-Parvati-Poller-Signature"
+
+// JSON body posted on a host status change
+type Transition struct {
+	Time     time.Time `json:"time"`
+	HostId   int64     `json:"host_id"`
+	HostName string    `json:"host_name"`
+	Address  string    `json:"address"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	Spectate *bool     `json:"spectate,omitempty"`
+	Version  string    `json:"version,omitempty"`
+	Profiles []string  `json:"profiles,omitempty"` // host then client, "" if not known
+}
+
+// Human readable summary, used for Discord messages
+func (t *Transition) String() string {
+	msg := fmt.Sprintf("**%s** (%s) is now %s, was %s", t.HostName, t.Address, t.To, t.From)
+	var names []string
+	for _, name := range t.Profiles {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		msg += ": " + strings.Join(names, " vs ")
+	}
+	if t.Spectate != nil {
+		if *t.Spectate {
+			msg += " (spectating allowed)"
+		} else {
+			msg += " (no spectating)"
+		}
+	}
+	return msg
+}
+
+// Posts host status changes to webhooks in the background.
+// Each host is notified about at most once per MinInterval; changes within
+// the interval are combined into one sent when it is up, from the status
+// before the first to the status after the last. Failed posts are retried
+// with backoff.
+type Notifier struct {
+	URLs        []string
+	Secret      string
+	Discord     bool     // post Discord style {"content": ...} messages
+	Statuses    []string // only notify changes to these statuses, all if empty
+	MinInterval time.Duration
+	Attempts    int
+
+	client *resty.Client
+	queue  chan *Transition
+	done   chan struct{}
+	lock   sync.Mutex
+	hosts  map[int64]*hostNotices
+	closed bool
+}
+
+// When a host was last notified about, and any change held back since
+type hostNotices struct {
+	last  time.Time
+	held  *Transition
+	timer *time.Timer
+}
+
+func NewNotifier(urls []string, secret string, discord bool) *Notifier {
+	n := &Notifier{
+		URLs:     urls,
+		Secret:   secret,
+		Discord:  discord,
+		Attempts: 3,
+		client:   resty.New().SetTimeout(10 * time.Second),
+		queue:    make(chan *Transition, 100),
+		done:     make(chan struct{}),
+		hosts:    make(map[int64]*hostNotices),
+	}
+	go n.run()
+	return n
+}
+
+// Queues a notification of the host's status change, or holds it until the
+// host's interval is up. Never blocks.
+func (n *Notifier) Notify(j *Job, from string, su *parvatigo.StatusUpdate) {
+	id := j.OrigHostStat.Host.BaseInfo.Id
+	t := &Transition{
+		Time:     su.CheckDate,
+		HostId:   id,
+		HostName: j.OrigHostStat.Host.BaseInfo.DisplayName,
+		Address:  j.Request.Address,
+		From:     from,
+		To:       su.Status,
+		Spectate: su.CanSpec,
+	}
+	if su.NewVers != nil {
+		t.Version = *su.NewVers
+	}
+	t.Profiles = UpdateProfiles(su)
+	now := time.Now()
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.closed {
+		return
+	}
+	h, ok := n.hosts[id]
+	if !ok {
+		h = &hostNotices{}
+		n.hosts[id] = h
+	}
+	if h.held != nil {
+		t.From = h.held.From
+		h.held = t
+		webhookLog.Debug("Combined with held notification", "host_id", id, "address", t.Address, "from", t.From, "to", t.To)
+		return
+	}
+	if ok && now.Sub(h.last) < n.MinInterval {
+		h.held = t
+		h.timer = time.AfterFunc(h.last.Add(n.MinInterval).Sub(now), func() { n.release(id) })
+		webhookLog.Debug("Rate limited, holding notification", "host_id", id, "address", t.Address)
+		return
+	}
+	if n.send(t) {
+		h.last = now
+	}
+}
+
+// Sends a host's held notification once its interval is up
+func (n *Notifier) release(id int64) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	h, ok := n.hosts[id]
+	if !ok || h.held == nil || n.closed {
+		return
+	}
+	if n.send(h.held) {
+		h.last = time.Now()
+	}
+	h.held, h.timer = nil, nil
+}
+
+// Queues the notification if wanted, call with the lock held. Changes which
+// came back to where they started are not worth a notification.
+func (n *Notifier) send(t *Transition) bool {
+	if t.From == t.To || !n.wanted(t.To) {
+		return false
+	}
+	select {
+	case n.queue <- t:
+		return true
+	default:
+		webhookLog.Warn("Queue full, dropping notification", "host_id", t.HostId, "address", t.Address)
+		return false
+	}
+}
+
+// Forgets hosts no longer listed, and those whose interval is up with
+// nothing held
+func (n *Notifier) Prune(hosts []swagger.HosterStatus) {
+	if n == nil {
+		return
+	}
+	listed := make(map[int64]bool, len(hosts))
+	for _, hs := range hosts {
+		listed[hs.Host.BaseInfo.Id] = true
+	}
+	now := time.Now()
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	for id, h := range n.hosts {
+		if h.held == nil && (!listed[id] || now.Sub(h.last) >= n.MinInterval) {
+			delete(n.hosts, id)
+		}
+	}
+}
+
+// Sends any held notifications and waits up to timeout for everything
+// queued to be posted, 0 for no limit. Held notifications which cannot be
+// queued in time are dropped. Later notifications are ignored.
+func (n *Notifier) Close(timeout time.Duration) {
+	if n == nil {
+		return
+	}
+	n.lock.Lock()
+	if n.closed {
+		n.lock.Unlock()
+		return
+	}
+	n.closed = true
+	var held []*Transition
+	for _, h := range n.hosts {
+		if h.held == nil {
+			continue
+		}
+		h.timer.Stop()
+		if h.held.From != h.held.To && n.wanted(h.held.To) {
+			held = append(held, h.held)
+		}
+		h.held, h.timer = nil, nil
+	}
+	n.lock.Unlock()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	// nothing else sends once closed, so the queue is ours to close
+	for i, t := range held {
+		select {
+		case n.queue <- t:
+		case <-expired:
+			webhookLog.Warn("Gave up queueing held notifications", "waited", timeout, "dropped", len(held)-i)
+			close(n.queue)
+			return
+		}
+	}
+	close(n.queue)
+	select {
+	case <-n.done:
+	case <-expired:
+		webhookLog.Warn("Gave up waiting for notifications to be posted", "waited", timeout)
+	}
+}
+
+func (n *Notifier) wanted(status string) bool {
+	if len(n.Statuses) == 0 {
+		return true
+	}
+	for _, s := range n.Statuses {
+		if strings.EqualFold(s, status) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+	for t := range n.queue {
+		body, err := n.body(t)
+		if err != nil {
+			webhookLog.Error("Unable to encode", "host_id", t.HostId, "address", t.Address, "error", err)
+			continue
+		}
+		for _, url := range n.URLs {
+			n.post(url, body)
+		}
+	}
+}
+
+func (n *Notifier) body(t *Transition) ([]byte, error) {
+	if n.Discord {
+		return json.Marshal(map[string]string{"content": t.String()})
+	}
+	return json.Marshal(t)
+}
+
+func (n *Notifier) post(url string, body []byte) {
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		request := n.client.R()
+		request.SetHeader("Content-Type", "application/json")
+		if n.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(n.Secret))
+			mac.Write(body)
+			request.SetHeader(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		request.SetBody(body)
+		response, err := request.Post(url)
+		if err == nil && response.IsSuccess() {
+			return
+		}
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = response.Status()
+		}
+		// client errors other than rate limiting will not get better on retry
+		if err == nil && response.StatusCode() < 500 && response.StatusCode() != 429 {
+			attempt = n.Attempts
+		}
+		if attempt >= n.Attempts {
+			webhookLog.Error("Post failed", "url", url, "attempts", attempt, "reason", reason)
+			return
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// A notifier collecting what it would post instead of posting it
+type testNotifier struct {
+	*Notifier
+	lock sync.Mutex
+	sent []*Transition
+}
+
+func newTestNotifier(interval time.Duration) *testNotifier {
+	n := &testNotifier{Notifier: &Notifier{
+		MinInterval: interval,
+		queue:       make(chan *Transition, 100),
+		done:        make(chan struct{}),
+		hosts:       make(map[int64]*hostNotices),
+	}}
+	go func() {
+		defer close(n.done)
+		for t := range n.queue {
+			n.lock.Lock()
+			n.sent = append(n.sent, t)
+			n.lock.Unlock()
+		}
+	}()
+	return n
+}
+
+func (n *testNotifier) Sent() []*Transition {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return append([]*Transition(nil), n.sent...)
+}
+
+func (n *testNotifier) change(t *testing.T, id int64, from string, to string) {
+	n.Notify(hostJob(t, testHost(id, from)), from, &parvatigo.StatusUpdate{HosterId: id, Status: to})
+}
+
+func TestNotifyCombinesWithinInterval(t *testing.T) {
+	n := newTestNotifier(50 * time.Millisecond)
+	n.change(t, 1, "Down", "Waiting")
+	n.change(t, 1, "Waiting", "Playing")
+	n.change(t, 1, "Playing", "Down")
+	n.change(t, 2, "Down", "Waiting")
+	time.Sleep(20 * time.Millisecond)
+	if sent := n.Sent(); len(sent) != 2 {
+		t.Fatalf("sent %d notifications before the interval was up, want one per host", len(sent))
+	}
+	time.Sleep(100 * time.Millisecond)
+	sent := n.Sent()
+	if len(sent) != 3 {
+		t.Fatalf("sent %d notifications, want the held changes combined into one", len(sent))
+	}
+	if last := sent[2]; last.HostId != 1 || last.From != "Waiting" || last.To != "Down" {
+		t.Errorf("combined notification %+v, want host 1 from Waiting to Down", last)
+	}
+}
+
+func TestNotifySkipsChangesBackToStart(t *testing.T) {
+	n := newTestNotifier(time.Hour)
+	n.change(t, 1, "Down", "Waiting")
+	n.change(t, 1, "Waiting", "Playing")
+	n.change(t, 1, "Playing", "Waiting")
+	n.Close(0)
+	if sent := n.Sent(); len(sent) != 1 {
+		t.Errorf("sent %+v, want only the first change", sent)
+	}
+}
+
+func TestNotifyCloseFlushesHeld(t *testing.T) {
+	n := newTestNotifier(time.Hour)
+	n.change(t, 1, "Down", "Waiting")
+	n.change(t, 1, "Waiting", "Playing")
+	n.Close(time.Second)
+	sent := n.Sent()
+	if len(sent) != 2 || sent[1].From != "Waiting" || sent[1].To != "Playing" {
+		t.Fatalf("sent %+v, want the held change flushed on close", sent)
+	}
+	n.change(t, 2, "Down", "Waiting") // must not panic
+}
+
+func TestNotifyPrune(t *testing.T) {
+	n := newTestNotifier(time.Hour)
+	n.change(t, 1, "Down", "Waiting")
+	n.change(t, 2, "Down", "Waiting")
+	n.change(t, 2, "Waiting", "Playing")
+	n.Prune([]swagger.HosterStatus{testHost(3, "Down")})
+	if _, ok := n.hosts[1]; ok {
+		t.Error("unlisted host 1 kept")
+	}
+	if _, ok := n.hosts[2]; !ok {
+		t.Error("unlisted host 2 forgotten while holding a notification")
+	}
+	n.Close(0)
+}
+
+func TestTransitionProfiles(t *testing.T) {
+	n := newTestNotifier(0)
+	p2 := "bob"
+	hs := testHost(1, "Down")
+	hs.Host.BaseInfo.DisplayName = "alice"
+	n.Notify(hostJob(t, hs), "Down", &parvatigo.StatusUpdate{HosterId: 1, Status: "Playing", Prof2Name: &p2})
+	n.Close(0)
+	sent := n.Sent()
+	if len(sent) != 1 || len(sent[0].Profiles) != 2 || sent[0].Profiles[0] != "" || sent[0].Profiles[1] != "bob" {
+		t.Fatalf("sent %+v, want the client profile alone", sent)
+	}
+	if got, want := sent[0].String(), "**alice** (192.0.2.1:10800) is now Playing, was Down: bob"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+// A poster stuck on a slow webhook must not hold Close past its timeout
+func TestNotifyCloseTimesOutOnFullQueue(t *testing.T) {
+	n := &testNotifier{Notifier: &Notifier{
+		MinInterval: time.Hour,
+		queue:       make(chan *Transition, 1),
+		done:        make(chan struct{}),
+		hosts:       make(map[int64]*hostNotices),
+	}} // nothing drains the queue
+	n.change(t, 1, "Down", "Waiting")
+	n.change(t, 1, "Waiting", "Playing")
+	n.change(t, 2, "Down", "Waiting") // fills the queue
+	n.change(t, 2, "Waiting", "Playing")
+	closed := make(chan struct{})
+	go func() {
+		n.Close(50 * time.Millisecond)
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close() blocked on a full queue past its timeout")
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/misatosangel/parvati-soku-checker/pkg/history"
+)
+
+// Running totals kept for the final summary, updated atomically
+type PoolStats struct {
+	Checks        uint64
+	CheckFailures uint64
+	Updates       uint64
+	UpdateErrors  uint64
+	Unchanged     uint64
+	WaitsEnded    uint64
+	Dropped       uint64
+}
+
+// The set of worker threads and everything they share
+type Pool struct {
+	// updated atomically, so first to be 64-bit aligned on 32-bit platforms
+	Stats PoolStats
+	busy  [256]int64 // unix nanoseconds each thread started its current job, 0 if idle
+
+	sink     StatusSink
+	sched    *Scheduler
+	debounce *Debouncer
+	store    *history.Store
+	inFlight *InFlight
+	queue    chan *Job
+	cancel   chan struct{} // closed when queued jobs should be dropped rather than run
+	shrink   chan struct{} // each value sent stops one idle worker
+	workers  sync.WaitGroup
+	live     int32         // workers running, including those yet to stop after a shrink
+	updates  int32         // non-zero if updates should be sent to Parvati
+	events   *EventWriter  // JSON lines output of each check, if on
+	notifier *Notifier     // webhooks for status changes, if on
+	health   *Health       // progress tracking for /healthz and /readyz, if on
+	waits    *WaitTimers   // waiter expiries, failed wait updates are retried through it
+	filter   *UpdateFilter // holds back unchanged updates
+	recorder *Recorder     // archive of lists and check results, if on
+	scaler   *AutoScaler   // grows and shrinks the pool with load, if on
+	depth    *CheckDepth   // picks each job's check level as it runs, unless replaying
+	check    CheckFunc     // CheckHost unless replaying
+
+	lock sync.Mutex // guards the below
+	size int
+	tids [256]bool // thread ids in use
+
+	pendLock sync.Mutex // guards the below
+	pending  []*Job     // due jobs which did not fit in the queue, oldest first
+	closed   bool       // queue closed for shutdown
+}
+
+func NewPool(sink StatusSink, sched *Scheduler, debounce *Debouncer, store *history.Store, queueLen int) *Pool {
+	return &Pool{
+		sink:     sink,
+		sched:    sched,
+		debounce: debounce,
+		store:    store,
+		inFlight: NewInFlight(),
+		queue:    make(chan *Job, queueLen),
+		cancel:   make(chan struct{}),
+		shrink:   make(chan struct{}, 256),
+		check:    CheckHost,
+	}
+}
+
+// Grows or shrinks the pool to the given number of worker threads.
+// Shrinking happens as workers next become idle, so growing first takes
+// back any stops not yet picked up.
+func (p *Pool) Resize(threads uint8) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for ; p.size < int(threads); p.size++ {
+		select {
+		case <-p.shrink:
+			continue // a worker due to stop carries on instead
+		default:
+		}
+		var tid uint8
+		for p.tids[tid] && tid < 255 {
+			tid++
+		}
+		p.tids[tid] = true
+		p.workers.Add(1)
+		atomic.AddInt32(&p.live, 1)
+		go p.Worker(tid)
+	}
+	for ; p.size > int(threads); p.size-- {
+		p.shrink <- struct{}{}
+	}
+}
+
+// Current number of worker threads
+func (p *Pool) Size() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.size
+}
+
+// Number of worker threads actually running, which is above Size until
+// those stopped by a shrink become idle
+func (p *Pool) Live() int {
+	return int(atomic.LoadInt32(&p.live))
+}
+
+// Whether updates are actually sent to Parvati
+func (p *Pool) Updating() bool {
+	return atomic.LoadInt32(&p.updates) != 0
+}
+
+func (p *Pool) SetUpdating(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&p.updates, v)
+}
+
+// Marks the thread as working on a job since the given time, or idle if zero
+func (p *Pool) setBusy(tid uint8, since time.Time) {
+	var nanos int64
+	if !since.IsZero() {
+		nanos = since.UnixNano()
+	}
+	atomic.StoreInt64(&p.busy[tid], nanos)
+}
+
+// Number of threads which have been working on one job for longer than max
+func (p *Pool) Stuck(now time.Time, max time.Duration) int {
+	stuck := 0
+	for i := range p.busy {
+		since := atomic.LoadInt64(&p.busy[i])
+		if since != 0 && now.Sub(time.Unix(0, since)) > max {
+			stuck++
+		}
+	}
+	return stuck
+}
+
+func (p *Pool) releaseTid(tid uint8) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.tids[tid] = false
+}
+
+// How Enqueue handled a job
+const (
+	QueuedOK       = iota
+	QueuedInFlight // skipped, already queued or being worked on
+	QueuedPending  // the queue was full, held until there is room
+)
+
+// Queues a job without ever blocking.
+// Jobs already in flight are skipped. Those which do not fit in the queue
+// are held back in order, and moved into it as workers make room.
+func (p *Pool) Enqueue(j *Job) int {
+	if !p.inFlight.Begin(j) {
+		skippedChecks.WithLabelValues("in_flight").Inc()
+		return QueuedInFlight
+	}
+	j.Queued = time.Now()
+	p.pendLock.Lock()
+	defer p.pendLock.Unlock()
+	if len(p.pending) == 0 {
+		select {
+		case p.queue <- j:
+			return QueuedOK
+		default:
+		}
+	}
+	p.pending = append(p.pending, j)
+	// the workers may have emptied the queue meanwhile, leaving nobody to
+	// come back for what is pending
+	p.feed()
+	return QueuedPending
+}
+
+// Moves pending jobs into the queue while there is room, call with
+// pendLock held
+func (p *Pool) feed() {
+	for len(p.pending) > 0 && !p.closed {
+		select {
+		case p.queue <- p.pending[0]:
+			p.pending[0] = nil
+			p.pending = p.pending[1:]
+		default:
+			return
+		}
+	}
+}
+
+// Tops the queue up from the pending jobs
+func (p *Pool) refill() {
+	p.pendLock.Lock()
+	defer p.pendLock.Unlock()
+	p.feed()
+}
+
+// Takes the oldest pending job, nil if there is none. For once the queue
+// is closed, as they can no longer be moved into it.
+func (p *Pool) popPending() *Job {
+	p.pendLock.Lock()
+	defer p.pendLock.Unlock()
+	if len(p.pending) == 0 {
+		return nil
+	}
+	j := p.pending[0]
+	p.pending[0] = nil
+	p.pending = p.pending[1:]
+	return j
+}
+
+// Number of due jobs waiting for room in the queue
+func (p *Pool) Pending() int {
+	p.pendLock.Lock()
+	defer p.pendLock.Unlock()
+	return len(p.pending)
+}
+
+// Stops accepting jobs and waits for the workers to finish.
+// Queued and pending jobs are still run until the timeout passes (forever
+// if zero), after which any left are dropped. Jobs already being worked on
+// (including their Parvati updates) are always allowed to finish.
+func (p *Pool) Shutdown(timeout time.Duration) {
+	p.pendLock.Lock()
+	p.closed = true
+	close(p.queue)
+	p.pendLock.Unlock()
+	done := make(chan struct{})
+	go func() {
+		p.workers.Wait()
+		close(done)
+	}()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+	select {
+	case <-done:
+		return
+	case <-expired:
+	}
+	close(p.cancel)
+	pollerLog.Warn("Shutdown timeout reached, dropping queued jobs", "queued", len(p.queue)+p.Pending())
+	<-done
+}
+
+// Logs the running totals
+func (p *Pool) LogSummary() {
+	pollerLog.Info("Summary",
+		"checks", atomic.LoadUint64(&p.Stats.Checks), "check_failures", atomic.LoadUint64(&p.Stats.CheckFailures),
+		"updates", atomic.LoadUint64(&p.Stats.Updates), "update_errors", atomic.LoadUint64(&p.Stats.UpdateErrors),
+		"unchanged", atomic.LoadUint64(&p.Stats.Unchanged), "waits_ended", atomic.LoadUint64(&p.Stats.WaitsEnded),
+		"dropped", atomic.LoadUint64(&p.Stats.Dropped), "threads", p.Size())
+}
@@ -0,0 +1,208 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"github.com/misatosangel/soku-net-checker/pkg/checker"
+)
+
+// Records what the pool sends it
+type testSink struct {
+	lock    sync.Mutex
+	updates []*parvatigo.StatusUpdate
+	ended   []int64
+	err     error // returned instead of recording when set
+}
+
+func (s *testSink) UpdateHostStatus(j *Job, su *parvatigo.StatusUpdate) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.updates = append(s.updates, su)
+	return nil
+}
+
+func (s *testSink) EndWait(j *Job) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.ended = append(s.ended, j.WaitStat.Waiter.User.Id)
+	return nil
+}
+
+// A pool sending every update, as the poller runs with --update and no
+// debouncing or heartbeat
+func newTestPool(sink StatusSink, queueLen int) *Pool {
+	pool := NewPool(sink, NewScheduler(time.Second, time.Minute, 2), NewDebouncer(1, 1), nil, queueLen)
+	pool.filter = NewUpdateFilter(0)
+	pool.SetUpdating(true)
+	return pool
+}
+
+func testHost(id int64, status string) swagger.HosterStatus {
+	var hs swagger.HosterStatus
+	hs.Host.BaseInfo.Id = id
+	hs.Host.Ipv4 = fmt.Sprintf("192.0.2.%d", id)
+	hs.Host.Port = 10800
+	hs.Status.Status = status
+	return hs
+}
+
+func hostJob(t *testing.T, hs swagger.HosterStatus) *Job {
+	req, err := checker.NewRequest(fmt.Sprintf("%s:%d", hs.Host.Ipv4, hs.Host.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Job{Request: req, OrigHostStat: hs}
+}
+
+func TestEnqueueHoldsJobsWhenQueueFull(t *testing.T) {
+	sink := &testSink{}
+	pool := newTestPool(sink, 1)
+	release := make(chan struct{})
+	pool.check = func(j *Job) (*parvatigo.StatusUpdate, *checker.CheckResult, error) {
+		<-release
+		result := &checker.CheckResult{Address: j.Request.Address, Status: "Waiting"}
+		return StatusFromResult(j, result, time.Now()), result, nil
+	}
+	pool.Resize(1)
+	const hosts = 20
+	counts := make(map[int]int)
+	for id := int64(1); id <= hosts; id++ {
+		counts[pool.Enqueue(hostJob(t, testHost(id, "Down")))]++
+	}
+	if counts[QueuedPending] == 0 {
+		t.Fatalf("Enqueue() results %v, expected some jobs held as pending", counts)
+	}
+	if got := pool.Enqueue(hostJob(t, testHost(hosts, "Down"))); got != QueuedInFlight {
+		t.Errorf("Enqueue() of a pending host = %d, want QueuedInFlight", got)
+	}
+	close(release)
+	pool.Shutdown(0)
+	if len(sink.updates) != hosts {
+		t.Fatalf("got %d updates, want one for each of the %d hosts", len(sink.updates), hosts)
+	}
+	seen := make(map[int64]bool)
+	for i, su := range sink.updates {
+		if seen[su.HosterId] {
+			t.Errorf("host %d updated twice", su.HosterId)
+		}
+		seen[su.HosterId] = true
+		if su.HosterId != int64(i+1) {
+			t.Errorf("update %d was for host %d, want hosts in the order queued", i, su.HosterId)
+		}
+	}
+	if pool.Pending() != 0 {
+		t.Errorf("%d jobs still pending after shutdown", pool.Pending())
+	}
+}
+
+func TestRunJobCountsOnlySentUpdates(t *testing.T) {
+	sink := &testSink{err: errors.New("parvati down")}
+	pool := newTestPool(sink, 1)
+	pool.check = func(j *Job) (*parvatigo.StatusUpdate, *checker.CheckResult, error) {
+		result := &checker.CheckResult{Address: j.Request.Address, Status: "Waiting"}
+		return StatusFromResult(j, result, time.Now()), result, nil
+	}
+	latency := checkDuration.WithLabelValues("test")
+	var ws swagger.WaiterStatus
+	ws.Waiter.User.Id = 7
+	pool.RunJob(0, latency, hostJob(t, testHost(1, "Down")))
+	pool.RunJob(0, latency, &Job{WaitStat: ws})
+	if got := atomic.LoadUint64(&pool.Stats.Updates); got != 0 {
+		t.Errorf("Updates = %d after a failed update, want 0", got)
+	}
+	if got := atomic.LoadUint64(&pool.Stats.WaitsEnded); got != 0 {
+		t.Errorf("WaitsEnded = %d after a failed wait update, want 0", got)
+	}
+	if got := atomic.LoadUint64(&pool.Stats.UpdateErrors); got != 2 {
+		t.Errorf("UpdateErrors = %d, want 2", got)
+	}
+
+	sink.err = nil
+	pool.RunJob(0, latency, hostJob(t, testHost(2, "Down")))
+	pool.RunJob(0, latency, &Job{WaitStat: ws})
+	if got := atomic.LoadUint64(&pool.Stats.Updates); got != 1 {
+		t.Errorf("Updates = %d after a sent update, want 1", got)
+	}
+	if got := atomic.LoadUint64(&pool.Stats.WaitsEnded); got != 1 {
+		t.Errorf("WaitsEnded = %d after an ended wait, want 1", got)
+	}
+}
+
+func TestShutdownTimeoutDropsPending(t *testing.T) {
+	sink := &testSink{}
+	pool := newTestPool(sink, 1)
+	release := make(chan struct{})
+	pool.check = func(j *Job) (*parvatigo.StatusUpdate, *checker.CheckResult, error) {
+		<-release
+		result := &checker.CheckResult{Address: j.Request.Address, Status: "Waiting"}
+		return StatusFromResult(j, result, time.Now()), result, nil
+	}
+	pool.Resize(1)
+	for id := int64(1); id <= 5; id++ {
+		pool.Enqueue(hostJob(t, testHost(id, "Down")))
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+	}()
+	pool.Shutdown(10 * time.Millisecond)
+	if len(sink.updates) != 1 {
+		t.Errorf("got %d updates, want only the job already being worked on", len(sink.updates))
+	}
+	if dropped := pool.Stats.Dropped; dropped != 4 {
+		t.Errorf("dropped %d jobs, want 4", dropped)
+	}
+}
+
+// Stops left over from a shrink must not also stop the workers a grow adds
+func TestResizeShrinkThenGrow(t *testing.T) {
+	sink := &testSink{}
+	pool := newTestPool(sink, 4)
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	pool.check = func(j *Job) (*parvatigo.StatusUpdate, *checker.CheckResult, error) {
+		started <- struct{}{}
+		<-release
+		result := &checker.CheckResult{Address: j.Request.Address, Status: "Waiting"}
+		return StatusFromResult(j, result, time.Now()), result, nil
+	}
+	pool.Resize(4)
+	for id := int64(1); id <= 4; id++ {
+		pool.Enqueue(hostJob(t, testHost(id, "Down")))
+	}
+	for i := 0; i < 4; i++ {
+		<-started // every worker busy, so none can take a stop yet
+	}
+	pool.Resize(1)
+	pool.Resize(4)
+	if live := pool.Live(); live != 4 {
+		t.Errorf("%d workers running after shrinking and growing back, want 4", live)
+	}
+	close(release)
+	for id := int64(5); id <= 8; id++ {
+		pool.Enqueue(hostJob(t, testHost(id, "Down")))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if live, size := pool.Live(), pool.Size(); live != 4 || size != 4 {
+		t.Errorf("%d workers running for a pool of %d, want 4", live, size)
+	}
+	pool.Shutdown(0)
+	if live := pool.Live(); live != 0 {
+		t.Errorf("%d workers running after shutdown", live)
+	}
+}
@@ -0,0 +1,221 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"github.com/misatosangel/soku-net-checker/pkg/checker"
+)
+
+// One line of a --record archive: either the host list fetched on a tick,
+// the result of a check queued on that tick, or a wait ended after it.
+// A check which failed, e.g. as its host was denied or rate limited, has
+// an error rather than a result.
+type ArchiveEntry struct {
+	Type    string                `json:"type"` // "list", "check" or "wait"
+	Cycle   uint64                `json:"cycle"`
+	Time    time.Time             `json:"time"`
+	List    *HostList             `json:"list,omitempty"`
+	HostId  int64                 `json:"host_id,omitempty"`
+	Roll    string                `json:"roll,omitempty"`
+	ToPoint uint                  `json:"to_point,omitempty"`
+	Address string                `json:"address,omitempty"` // requested, the result holds the one which answered
+	Result  *checker.CheckResult  `json:"result,omitempty"`
+	Error   string                `json:"error,omitempty"`
+	Wait    *swagger.WaiterStatus `json:"wait,omitempty"`
+}
+
+// Appends archive entries as JSON lines, safe for use by many workers.
+// A nil Recorder records nothing.
+type Recorder struct {
+	lock sync.Mutex
+	out  *os.File
+	enc  *json.Encoder
+}
+
+func OpenRecorder(path string) (*Recorder, error) {
+	fh, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{out: fh, enc: json.NewEncoder(fh)}, nil
+}
+
+func (r *Recorder) List(cycle uint64, when time.Time, list *HostList) {
+	r.write(&ArchiveEntry{Type: "list", Cycle: cycle, Time: when, List: list})
+}
+
+func (r *Recorder) Check(j *Job, result *checker.CheckResult, when time.Time) {
+	e := checkEntry(j, when)
+	e.Result = result
+	r.write(e)
+}
+
+func (r *Recorder) Failed(j *Job, err error, when time.Time) {
+	e := checkEntry(j, when)
+	e.Error = err.Error()
+	r.write(e)
+}
+
+func (r *Recorder) Wait(j *Job, when time.Time) {
+	ws := j.WaitStat
+	r.write(&ArchiveEntry{Type: "wait", Cycle: j.Cycle, Time: when, Wait: &ws})
+}
+
+func checkEntry(j *Job, when time.Time) *ArchiveEntry {
+	return &ArchiveEntry{
+		Type:    "check",
+		Cycle:   j.Cycle,
+		Time:    when,
+		HostId:  j.OrigHostStat.Host.BaseInfo.Id,
+		Roll:    j.Roll,
+		ToPoint: j.ToPoint,
+		Address: j.Request.Address,
+	}
+}
+
+func (r *Recorder) write(e *ArchiveEntry) {
+	if r == nil {
+		return
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.enc.Encode(e); err != nil {
+		replayLog.Error("Recording failed", "type", e.Type, "cycle", e.Cycle, "error", err)
+	}
+}
+
+func (r *Recorder) Close() error {
+	return r.out.Close()
+}
+
+// A recorded tick: the host list, and the checks queued from it and waits
+// ended after it, in the order they were done
+type ArchiveCycle struct {
+	Cycle uint64
+	Time  time.Time
+	List  *HostList
+	Jobs  []*ArchiveEntry
+}
+
+// Reads a whole archive, cycles in order
+func ReadArchive(path string) ([]*ArchiveCycle, error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+	cycles := make(map[uint64]*ArchiveCycle)
+	get := func(n uint64) *ArchiveCycle {
+		c, ok := cycles[n]
+		if !ok {
+			c = &ArchiveCycle{Cycle: n}
+			cycles[n] = c
+		}
+		return c
+	}
+	scanner := bufio.NewScanner(fh)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e ArchiveEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return nil, fmt.Errorf("%s line %d: %s", path, line, err.Error())
+		}
+		switch e.Type {
+		case "list":
+			c := get(e.Cycle)
+			c.Time = e.Time
+			c.List = e.List
+		case "check", "wait":
+			c := get(e.Cycle)
+			c.Jobs = append(c.Jobs, &e)
+		default:
+			return nil, fmt.Errorf("%s line %d: unknown entry type '%s'", path, line, e.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	out := make([]*ArchiveCycle, 0, len(cycles))
+	for _, c := range cycles {
+		if c.List != nil {
+			out = append(out, c)
+		}
+	}
+	sort.Slice(out, func(a, b int) bool { return out[a].Cycle < out[b].Cycle })
+	return out, nil
+}
+
+// Runs every recorded check and ended wait through the pool's job handling
+// again, one at a time, with the recorded results and errors standing in
+// for the network. Which hosts get checked comes from the archive rather
+// than the scheduler, but debouncing, update filtering and everything
+// downstream behave as live.
+func ReplayArchive(pool *Pool, path string, game *swagger.Game) int {
+	cycles, err := ReadArchive(path)
+	if err != nil {
+		replayLog.Fatal("Failed to read archive", "path", path, "error", err)
+	}
+	var current *ArchiveEntry
+	pool.depth = nil // checked at the recorded levels
+	pool.store = nil // never mixed in with live history
+	pool.check = func(j *Job) (*parvatigo.StatusUpdate, *checker.CheckResult, error) {
+		if current.Error != "" {
+			return nil, nil, errors.New(current.Error)
+		}
+		return StatusFromResult(j, current.Result, current.Time), current.Result, nil
+	}
+	latency := checkDuration.WithLabelValues("replay")
+	replayLog.Info("Replaying", "cycles", len(cycles), "path", path)
+	for _, c := range cycles {
+		pool.sched.Prune(c.List.Hosts)
+		pool.debounce.Prune(c.List.Hosts)
+		pool.filter.Prune(c.List.Hosts)
+		hosts := make(map[int64]swagger.HosterStatus, len(c.List.Hosts))
+		for _, hs := range c.List.Hosts {
+			hosts[hs.Host.BaseInfo.Id] = hs
+		}
+		for _, e := range c.Jobs {
+			if e.Type == "wait" {
+				if e.Wait == nil {
+					replayLog.Warn("Skipping wait with no waiter", "cycle", c.Cycle)
+					continue
+				}
+				pool.RunJob(0, latency, &Job{WaitStat: *e.Wait, Game: game, Cycle: c.Cycle})
+				continue
+			}
+			hs, ok := hosts[e.HostId]
+			if !ok || e.Result == nil && e.Error == "" {
+				replayLog.Warn("Skipping check of host not in its cycle's list", "cycle", c.Cycle, "host_id", e.HostId)
+				continue
+			}
+			req, err := checker.NewRequest(e.Address)
+			if err != nil {
+				replayLog.Warn("Skipping check", "cycle", c.Cycle, "host_id", e.HostId, "error", err)
+				continue
+			}
+			current = e
+			pool.RunJob(0, latency, &Job{
+				Roll:         e.Roll,
+				Request:      req,
+				ToPoint:      e.ToPoint,
+				Queued:       e.Time, // next due from when it was checked
+				OrigHostStat: hs,
+				Game:         game,
+				Cycle:        c.Cycle,
+			})
+		}
+	}
+	pool.LogSummary()
+	return 0
+}
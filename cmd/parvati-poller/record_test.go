@@ -0,0 +1,76 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+	"github.com/misatosangel/parvati-soku-checker/pkg/history"
+	"github.com/misatosangel/soku-net-checker/pkg/checker"
+)
+
+// Failed checks and ended waits are archived and replayed alongside checks
+func TestRecordAndReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "archive.jsonl")
+	recorder, err := OpenRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up, denied := testHost(1, "Down"), testHost(2, "Down")
+	var ws swagger.WaiterStatus
+	ws.Waiter.User.Id = 7
+	now := time.Now()
+	recorder.List(1, now, &HostList{Hosts: []swagger.HosterStatus{up, denied}, Waits: []swagger.WaiterStatus{ws}})
+	upJob, deniedJob := hostJob(t, up), hostJob(t, denied)
+	upJob.Cycle, deniedJob.Cycle = 1, 1
+	recorder.Check(upJob, &checker.CheckResult{Address: upJob.Request.Address, Status: "Waiting"}, now)
+	recorder.Failed(deniedJob, errors.New("Destination address is not allowed"), now)
+	recorder.Wait(&Job{WaitStat: ws, Cycle: 1}, now)
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	cycles, err := ReadArchive(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cycles) != 1 || len(cycles[0].Jobs) != 3 {
+		t.Fatalf("read %d cycles, want one with three jobs", len(cycles))
+	}
+	if failed := cycles[0].Jobs[1]; failed.Result != nil || failed.Error != "Destination address is not allowed" {
+		t.Errorf("failed check read as %+v", failed)
+	}
+
+	store, err := history.Open(filepath.Join(dir, "history.db"), history.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	sink := &testSink{}
+	pool := newTestPool(sink, 1)
+	pool.store = store
+	ReplayArchive(pool, path, &swagger.Game{UrlShortName: "soku"})
+	if last, err := store.Last(1); err != nil || last != nil {
+		t.Errorf("replay wrote %+v, %v to the history, want nothing", last, err)
+	}
+	if len(sink.updates) != 1 || sink.updates[0].HosterId != 1 {
+		t.Errorf("replay sent updates %+v, want host 1's only", sink.updates)
+	}
+	if pool.Stats.CheckFailures != 1 {
+		t.Errorf("replay had %d check failures, want the denied host's", pool.Stats.CheckFailures)
+	}
+	if len(sink.ended) != 1 || sink.ended[0] != 7 {
+		t.Errorf("replay ended waits %v, want user 7's", sink.ended)
+	}
+}
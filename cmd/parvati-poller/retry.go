@@ -0,0 +1,34 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// How often and how quickly a host which looks down is re-probed before
+// believing it.
+type RetryPolicy struct {
+	Attempts int           // total attempts, 1 means no retries
+	Backoff  time.Duration // wait before the first retry, doubling each retry after
+	Jitter   time.Duration // up to this much random extra wait per retry
+}
+
+// The retry policy from the command line settings
+func SettingsRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts: settings.Retries,
+		Backoff:  settings.RetryWait,
+		Jitter:   settings.Jitter,
+	}
+}
+
+// How long to wait before the given retry (1 being the first retry)
+func (r RetryPolicy) Delay(retry int) time.Duration {
+	wait := r.Backoff << uint(retry-1)
+	if r.Jitter > 0 {
+		wait += time.Duration(rand.Int63n(int64(r.Jitter)))
+	}
+	return wait
+}
@@ -0,0 +1,105 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// Per host scheduling state
+type hostSchedule struct {
+	listed   string        // status Parvati had for the host when last checked
+	status   string        // status the last check found
+	interval time.Duration // current wait between checks
+	next     time.Time     // host is not due again until this time
+}
+
+// Decides which listed hosts are due a check.
+// Hosts which keep reporting the same status have their check interval
+// backed off (up to Max), any change in status drops it back to Min.
+type Scheduler struct {
+	Min     time.Duration
+	Max     time.Duration
+	Backoff float64
+
+	lock  sync.Mutex
+	hosts map[int64]*hostSchedule
+}
+
+func NewScheduler(min, max time.Duration, backoff float64) *Scheduler {
+	if max < min {
+		max = min
+	}
+	if backoff < 1 {
+		backoff = 1
+	}
+	return &Scheduler{
+		Min:     min,
+		Max:     max,
+		Backoff: backoff,
+		hosts:   make(map[int64]*hostSchedule),
+	}
+}
+
+// Hosts this close to being due count as due, as a fraction of Min, so a
+// host whose interval matches the list frequency is not skipped when a list
+// comes in a little early
+const dueSlack = 10
+
+// Returns true if the given host should be checked now.
+// Hosts never seen before, or whose status on Parvati has changed since we
+// last checked them, are always due.
+func (s *Scheduler) Due(hs *swagger.HosterStatus, now time.Time) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sched, ok := s.hosts[hs.Host.BaseInfo.Id]
+	if !ok {
+		return true
+	}
+	if sched.listed != hs.Status.Status {
+		return true
+	}
+	return !now.Add(s.Min / dueSlack).Before(sched.next)
+}
+
+// Records the outcome of a check on a host and works out when it is next
+// due, counting from when the check was queued rather than when it ended.
+func (s *Scheduler) Record(hs *swagger.HosterStatus, status string, queued time.Time) time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sched, ok := s.hosts[hs.Host.BaseInfo.Id]
+	if !ok {
+		sched = &hostSchedule{}
+		s.hosts[hs.Host.BaseInfo.Id] = sched
+	}
+	if !ok || sched.status != status {
+		sched.interval = s.Min
+	} else {
+		sched.interval = time.Duration(float64(sched.interval) * s.Backoff)
+		if sched.interval > s.Max {
+			sched.interval = s.Max
+		}
+	}
+	sched.listed = hs.Status.Status
+	sched.status = status
+	sched.next = queued.Add(sched.interval)
+	return sched.interval
+}
+
+// Drops state for any host not in the given list (e.g. no longer hosting).
+func (s *Scheduler) Prune(hosts []swagger.HosterStatus) {
+	listed := make(map[int64]bool, len(hosts))
+	for _, hs := range hosts {
+		listed[hs.Host.BaseInfo.Id] = true
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for id := range s.hosts {
+		if !listed[id] {
+			delete(s.hosts, id)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// With --min-interval equal to --frequency every list is due a check of a
+// host whose status keeps changing, however long the checks take and even
+// if the list comes in a little early
+func TestDueAtListFrequency(t *testing.T) {
+	const frequency = 5 * time.Second
+	s := NewScheduler(frequency, time.Minute, 2)
+	hs := testHost(1, "Down")
+	tick := time.Unix(1000, 0)
+	statuses := []string{"Waiting", "Playing", "Waiting", "Playing"}
+	for i, status := range statuses {
+		// the listed status stays put, so only timing makes it due
+		listed := tick.Add(time.Duration(i)*frequency - time.Duration(i%2)*100*time.Millisecond)
+		if !s.Due(&hs, listed) {
+			t.Fatalf("check %d not due at the list frequency", i)
+		}
+		s.Record(&hs, status, listed.Add(time.Millisecond))
+	}
+}
+
+func TestDueBacksOff(t *testing.T) {
+	s := NewScheduler(5*time.Second, 20*time.Second, 2)
+	hs := testHost(1, "Down")
+	start := time.Unix(1000, 0)
+	if !s.Due(&hs, start) {
+		t.Fatal("host never seen not due")
+	}
+	if got := s.Record(&hs, "Down", start); got != 5*time.Second {
+		t.Errorf("first interval %s, want Min", got)
+	}
+	if got := s.Record(&hs, "Down", start); got != 10*time.Second {
+		t.Errorf("interval of an unchanged status %s, want it doubled", got)
+	}
+	if s.Due(&hs, start.Add(5*time.Second)) {
+		t.Error("host due before its backed off interval")
+	}
+	if !s.Due(&hs, start.Add(10*time.Second)) {
+		t.Error("host not due after its backed off interval")
+	}
+	s.Record(&hs, "Down", start)
+	if got := s.Record(&hs, "Down", start); got != 20*time.Second {
+		t.Errorf("interval %s, want it capped at Max", got)
+	}
+	if got := s.Record(&hs, "Waiting", start); got != 5*time.Second {
+		t.Errorf("interval after a change %s, want Min", got)
+	}
+	hs.Status.Status = "Playing"
+	if !s.Due(&hs, start) {
+		t.Error("host whose listed status changed not due")
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Heartbeat file content, one file per shard in the shard directory
+type ShardLease struct {
+	Shard     int       `json:"shard"`
+	Instance  string    `json:"instance"`
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+// Splits hosts between poller instances sharing a directory.
+// Each host id hashes to one of Count shards. An instance owns its own shard
+// and, while their instances' heartbeats are older than Lease, a share of any
+// dead shards, so that every shard is polled by exactly one live instance.
+type Sharder struct {
+	Dir      string
+	Index    int
+	Count    int
+	Lease    time.Duration
+	Instance string
+
+	lock    sync.Mutex
+	live    []int // shards with a live instance, sorted, always including Index
+	owned   []int
+	stop    chan struct{} // see KeepAlive
+	stopped chan struct{}
+}
+
+func NewSharder(dir string, index int, count int, lease time.Duration) (*Sharder, error) {
+	if index < 0 || index >= count {
+		return nil, fmt.Errorf("Shard index %d is not between 0 and %d", index, count-1)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &Sharder{
+		Dir:      dir,
+		Index:    index,
+		Count:    count,
+		Lease:    lease,
+		Instance: fmt.Sprintf("%s:%d", host, os.Getpid()),
+		live:     []int{index},
+		owned:    []int{index},
+	}, nil
+}
+
+// Refreshes this instance's lease and re-reads everyone else's.
+func (s *Sharder) Heartbeat(now time.Time) error {
+	path := s.leasePath(s.Index)
+	if other, err := readLease(path); err == nil && other.Instance != s.Instance && now.Sub(other.Heartbeat) < s.Lease {
+		shardLog.Warn("Shard is also being polled by another instance", "shard", s.Index, "instance", other.Instance)
+	}
+	err := writeLease(path, &ShardLease{Shard: s.Index, Instance: s.Instance, Heartbeat: now})
+	if err != nil {
+		return err
+	}
+	live := []int{s.Index}
+	for shard := 0; shard < s.Count; shard++ {
+		if shard == s.Index {
+			continue
+		}
+		lease, err := readLease(s.leasePath(shard))
+		if err == nil && now.Sub(lease.Heartbeat) < s.Lease {
+			live = append(live, shard)
+		}
+	}
+	sort.Ints(live)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.live = live
+	var owned []int
+	for shard := 0; shard < s.Count; shard++ {
+		if s.owner(shard) == s.Index {
+			owned = append(owned, shard)
+		}
+	}
+	if !reflect.DeepEqual(owned, s.owned) {
+		shardLog.Info("Shards changed", "owned", fmt.Sprint(owned), "shards", s.Count, "live", len(live))
+	}
+	s.owned = owned
+	return nil
+}
+
+// Renews the lease every interval in the background until Release, so it
+// stays live however long fetching the host list takes
+func (s *Sharder) KeepAlive(every time.Duration) {
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
+	go func() {
+		defer close(s.stopped)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				if err := s.Heartbeat(now); err != nil {
+					shardLog.Error("Unable to renew lease", "shard", s.Index, "error", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Gives up this instance's lease so others take over its shard straight away
+func (s *Sharder) Release() error {
+	if s.stop != nil {
+		close(s.stop)
+		<-s.stopped
+		s.stop = nil
+	}
+	return os.Remove(s.leasePath(s.Index))
+}
+
+// Whether this instance should poll the host or waiter with the given id
+func (s *Sharder) Owns(id int64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.owner(s.Shard(id)) == s.Index
+}
+
+// The shard an id hashes to
+func (s *Sharder) Shard(id int64) int {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(id))
+	h := fnv.New32a()
+	h.Write(buf)
+	return int(h.Sum32() % uint32(s.Count))
+}
+
+// A live shard owns itself, dead ones are spread over the live ones.
+// call with the lock held
+func (s *Sharder) owner(shard int) int {
+	i := sort.SearchInts(s.live, shard)
+	if i < len(s.live) && s.live[i] == shard {
+		return shard
+	}
+	return s.live[shard%len(s.live)]
+}
+
+func (s *Sharder) leasePath(shard int) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("shard-%d.json", shard))
+}
+
+func readLease(path string) (*ShardLease, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lease ShardLease
+	if err := json.Unmarshal(data, &lease); err != nil {
+		return nil, err
+	}
+	return &lease, nil
+}
+
+// Written to a temporary file and renamed so readers never see half a lease
+func writeLease(path string, lease *ShardLease) error {
+	data, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Cuts the list down to the hosts and waiters this instance owns
+func shardList(sharder *Sharder, list *HostList) *HostList {
+	owned := &HostList{}
+	for _, hs := range list.Hosts {
+		if sharder.Owns(hs.Host.BaseInfo.Id) {
+			owned.Hosts = append(owned.Hosts, hs)
+		}
+	}
+	for _, ws := range list.Waits {
+		if sharder.Owns(ws.Waiter.User.Id) {
+			owned.Waits = append(owned.Waits, ws)
+		}
+	}
+	return owned
+}
@@ -0,0 +1,76 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestKeepAliveRenewsLease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sharder, err := NewSharder(dir, 0, 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	sharder.KeepAlive(10 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	lease, err := readLease(sharder.leasePath(0))
+	if err != nil {
+		t.Fatalf("no lease written: %s", err)
+	}
+	if !lease.Heartbeat.After(start) || lease.Instance != sharder.Instance {
+		t.Errorf("lease %+v not renewed since %s", lease, start)
+	}
+	if err := sharder.Release(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := readLease(sharder.leasePath(0)); !os.IsNotExist(err) {
+		t.Errorf("lease still there after Release: %v", err)
+	}
+}
+
+func TestDeadShardsShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shards")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Now()
+	a, _ := NewSharder(dir, 0, 2, time.Minute)
+	b, _ := NewSharder(dir, 1, 2, time.Minute)
+	b.Instance = "other"
+	for _, s := range []*Sharder{b, a, b} { // b again to see a
+		if err := s.Heartbeat(now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var ownedByA, ownedByB int
+	for id := int64(0); id < 100; id++ {
+		if a.Owns(id) {
+			ownedByA++
+		}
+		if b.Owns(id) {
+			ownedByB++
+		}
+	}
+	if ownedByA+ownedByB != 100 || ownedByA == 0 || ownedByB == 0 {
+		t.Errorf("live shards own %d and %d of 100 ids, want a split", ownedByA, ownedByB)
+	}
+	if err := a.Heartbeat(now.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(0); id < 100; id++ {
+		if !a.Owns(id) {
+			t.Fatalf("id %d not owned once the other shard's lease ran out", id)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// The hosts and waiters to look at on a tick
+type HostList struct {
+	Hosts []swagger.HosterStatus
+	Waits []swagger.WaiterStatus
+}
+
+// Where the list of hosts to check comes from
+type HostSource interface {
+	ListHosts() (*HostList, error)
+	String() string
+}
+
+// Where the results of checks go
+type StatusSink interface {
+	UpdateHostStatus(j *Job, su *parvatigo.StatusUpdate) error
+	EndWait(j *Job) error
+}
+
+// Parvati as both a host source and status sink.
+// The API can be swapped out if the credentials change.
+type ParvatiClient struct {
+	game *swagger.Game
+	lock sync.Mutex
+	api  *parvatigo.Api
+}
+
+func NewParvatiClient(api *parvatigo.Api, game *swagger.Game) *ParvatiClient {
+	return &ParvatiClient{api: api, game: game}
+}
+
+func (c *ParvatiClient) Api() *parvatigo.Api {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.api
+}
+
+func (c *ParvatiClient) SetApi(api *parvatigo.Api) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.api = api
+}
+
+func (c *ParvatiClient) String() string {
+	return c.Api().Info()
+}
+
+func (c *ParvatiClient) ListHosts() (*HostList, error) {
+	list, err := c.Api().CheckListedHosts(c.game, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &HostList{Hosts: list.Hosts, Waits: list.Waits}, nil
+}
+
+func (c *ParvatiClient) UpdateHostStatus(j *Job, su *parvatigo.StatusUpdate) error {
+	ret, apiErr := c.Api().UpdateHostStatus(j.Game, *su)
+	if apiErr != nil {
+		return apiErr
+	}
+	parvatiLog.Debug("Updated host status", "host_id", su.HosterId, "address", j.Request.Address, "check_id", ret.Id,
+		"status", ret.Status, "was", j.OrigHostStat.Status.Status, "spectate", ret.CanSpec, "version", ret.Version,
+		"profile1", ret.P1Profile, "profile2", ret.P2Profile)
+	return nil
+}
+
+func (c *ParvatiClient) EndWait(j *Job) error {
+	apiErr := c.Api().UpdateWaitTime(j.Game, j.WaitStat.Waiter.User.Id, 0, "")
+	if apiErr != nil {
+		return apiErr
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// What Parvati was last told about a host
+type sentStatus struct {
+	status   string
+	spectate string // yes, no or unknown
+	version  string
+	profile1 string
+	profile2 string
+	opponent string
+	listed   bool // taken from the host list, which has no opponent
+	when     time.Time
+}
+
+func updateStatus(su *parvatigo.StatusUpdate, when time.Time) *sentStatus {
+	s := &sentStatus{status: su.Status, spectate: "unknown", opponent: su.OpponentAddr, when: when}
+	if su.CanSpec != nil {
+		if *su.CanSpec {
+			s.spectate = "yes"
+		} else {
+			s.spectate = "no"
+		}
+	}
+	if su.NewVers != nil {
+		s.version = *su.NewVers
+	}
+	if su.Prof1Name != nil {
+		s.profile1 = *su.Prof1Name
+	}
+	if su.Prof2Name != nil {
+		s.profile2 = *su.Prof2Name
+	}
+	return s
+}
+
+// The host list does not say when its status was sent, so it is taken as
+// never and the first update is always due as a heartbeat
+func listedStatus(hs *swagger.HosterStatus) *sentStatus {
+	s := &sentStatus{
+		status:   hs.Status.Status,
+		spectate: hs.Status.CanSpec,
+		version:  hs.Status.Version,
+		profile1: hs.Status.P1Profile,
+		profile2: hs.Status.P2Profile,
+		listed:   true,
+	}
+	if s.spectate != "yes" && s.spectate != "no" {
+		s.spectate = "unknown"
+	}
+	return s
+}
+
+func (s *sentStatus) same(o *sentStatus) bool {
+	if s.status != o.status || s.spectate != o.spectate || s.version != o.version || s.profile1 != o.profile1 || s.profile2 != o.profile2 {
+		return false
+	}
+	return s.listed || o.listed || s.opponent == o.opponent
+}
+
+// Holds back host status updates which would tell Parvati nothing new,
+// except for a heartbeat update at least every Heartbeat so Parvati knows
+// the host is still being checked.
+type UpdateFilter struct {
+	Heartbeat time.Duration // 0 sends every update
+
+	lock  sync.Mutex
+	hosts map[int64]*sentStatus
+}
+
+func NewUpdateFilter(heartbeat time.Duration) *UpdateFilter {
+	return &UpdateFilter{Heartbeat: heartbeat, hosts: make(map[int64]*sentStatus)}
+}
+
+// Whether the update should be sent. A host not seen before is compared
+// with its listed status, which is always due a heartbeat.
+func (f *UpdateFilter) Wanted(hs *swagger.HosterStatus, su *parvatigo.StatusUpdate, now time.Time) bool {
+	if f.Heartbeat <= 0 {
+		return true
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	last, ok := f.hosts[hs.Host.BaseInfo.Id]
+	if !ok {
+		last = listedStatus(hs)
+		f.hosts[hs.Host.BaseInfo.Id] = last
+	}
+	return !last.same(updateStatus(su, now)) || now.Sub(last.when) >= f.Heartbeat
+}
+
+// Records a successfully sent update
+func (f *UpdateFilter) Sent(hs *swagger.HosterStatus, su *parvatigo.StatusUpdate, now time.Time) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.hosts[hs.Host.BaseInfo.Id] = updateStatus(su, now)
+}
+
+// Forgets hosts no longer listed
+func (f *UpdateFilter) Prune(hosts []swagger.HosterStatus) {
+	listed := make(map[int64]bool, len(hosts))
+	for _, hs := range hosts {
+		listed[hs.Host.BaseInfo.Id] = true
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for id := range f.hosts {
+		if !listed[id] {
+			delete(f.hosts, id)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+)
+
+func TestUpdateFilter(t *testing.T) {
+	f := NewUpdateFilter(time.Minute)
+	hs := testHost(1, "Waiting")
+	hs.Status.CanSpec = "unknown"
+	waiting := &parvatigo.StatusUpdate{HosterId: 1, Status: "Waiting"}
+	playing := &parvatigo.StatusUpdate{HosterId: 1, Status: "Playing"}
+	now := time.Now()
+	if !f.Wanted(&hs, waiting, now) {
+		t.Error("first update of a host matching its listing not sent, want it due a heartbeat")
+	}
+	f.Sent(&hs, waiting, now)
+	if f.Wanted(&hs, waiting, now.Add(time.Second)) {
+		t.Error("unchanged update sent before the heartbeat")
+	}
+	if !f.Wanted(&hs, playing, now.Add(time.Second)) {
+		t.Error("changed update held back")
+	}
+	if !f.Wanted(&hs, waiting, now.Add(time.Minute)) {
+		t.Error("unchanged update held back after the heartbeat")
+	}
+	f.Prune(nil)
+	if !f.Wanted(&hs, waiting, now.Add(time.Second)) {
+		t.Error("pruned host not due a heartbeat")
+	}
+	if every := NewUpdateFilter(0); !every.Wanted(&hs, waiting, now) || !every.Wanted(&hs, waiting, now) {
+		t.Error("update held back with no heartbeat set")
+	}
+}
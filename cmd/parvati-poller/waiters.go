@@ -0,0 +1,150 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// Keeps each listed waiter's expiry in a heap so its wait can be ended
+// right when it runs out rather than on the next tick. Waiters already
+// ended are remembered until Parvati stops listing them, or extends their
+// wait.
+type WaitTimers struct {
+	lock    sync.Mutex
+	heap    waitHeap
+	entries map[int64]*waitEntry
+	ended   map[int64]time.Time // WaitUntil of waiters already ended, by user id
+}
+
+type waitEntry struct {
+	status swagger.WaiterStatus
+	at     time.Time // when to end the wait, after WaitUntil if retrying
+	index  int
+}
+
+func NewWaitTimers() *WaitTimers {
+	return &WaitTimers{
+		entries: make(map[int64]*waitEntry),
+		ended:   make(map[int64]time.Time),
+	}
+}
+
+// Brings the timers in line with the waiters currently listed
+func (w *WaitTimers) Sync(waits []swagger.WaiterStatus) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	listed := make(map[int64]bool, len(waits))
+	for _, ws := range waits {
+		id := ws.Waiter.User.Id
+		until := ws.Waiter.WaitUntil.UTC()
+		listed[id] = true
+		if ended, ok := w.ended[id]; ok {
+			if ended.Equal(until) {
+				continue // Parvati has not caught up yet
+			}
+			delete(w.ended, id) // wait extended since
+		}
+		if e, ok := w.entries[id]; ok {
+			if !e.status.Waiter.WaitUntil.UTC().Equal(until) {
+				e.status = ws
+				e.at = until
+				heap.Fix(&w.heap, e.index)
+			}
+			continue
+		}
+		e := &waitEntry{status: ws, at: until}
+		w.entries[id] = e
+		heap.Push(&w.heap, e)
+	}
+	for id, e := range w.entries {
+		if !listed[id] {
+			heap.Remove(&w.heap, e.index)
+			delete(w.entries, id)
+		}
+	}
+	for id := range w.ended {
+		if !listed[id] {
+			delete(w.ended, id)
+		}
+	}
+}
+
+// Removes and returns the waiters whose waits have run out, remembering
+// them as ended
+func (w *WaitTimers) Expired(now time.Time) []swagger.WaiterStatus {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	var out []swagger.WaiterStatus
+	for len(w.heap) > 0 && !w.heap[0].at.After(now) {
+		e := heap.Pop(&w.heap).(*waitEntry)
+		id := e.status.Waiter.User.Id
+		delete(w.entries, id)
+		w.ended[id] = e.status.Waiter.WaitUntil.UTC()
+		out = append(out, e.status)
+	}
+	return out
+}
+
+// Tries ending the wait again at the given time, e.g. after a failed update
+func (w *WaitTimers) Retry(ws swagger.WaiterStatus, at time.Time) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	id := ws.Waiter.User.Id
+	delete(w.ended, id)
+	if e, ok := w.entries[id]; ok {
+		e.at = at
+		heap.Fix(&w.heap, e.index)
+		return
+	}
+	e := &waitEntry{status: ws, at: at}
+	w.entries[id] = e
+	heap.Push(&w.heap, e)
+}
+
+// When the next wait runs out, false if there are no waiters
+func (w *WaitTimers) Next() (time.Time, bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if len(w.heap) == 0 {
+		return time.Time{}, false
+	}
+	return w.heap[0].at, true
+}
+
+// Number of waiters being timed
+func (w *WaitTimers) Len() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.heap)
+}
+
+// container/heap ordering by expiry
+type waitHeap []*waitEntry
+
+func (h waitHeap) Len() int           { return len(h) }
+func (h waitHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h waitHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waitHeap) Push(x interface{}) {
+	e := x.(*waitEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *waitHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return e
+}
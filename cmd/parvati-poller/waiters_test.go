@@ -0,0 +1,110 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+func waiter(id int64, until time.Time) swagger.WaiterStatus {
+	var ws swagger.WaiterStatus
+	ws.Waiter.User.Id = id
+	ws.Waiter.WaitUntil = until
+	return ws
+}
+
+func expiredIds(w *WaitTimers, now time.Time) []int64 {
+	var ids []int64
+	for _, ws := range w.Expired(now) {
+		ids = append(ids, ws.Waiter.User.Id)
+	}
+	return ids
+}
+
+func sameIds(got []int64, want ...int64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestWaitTimersPopInExpiryOrder(t *testing.T) {
+	start := time.Unix(1000, 0).UTC()
+	w := NewWaitTimers()
+	w.Sync([]swagger.WaiterStatus{
+		waiter(1, start.Add(3*time.Minute)),
+		waiter(2, start.Add(time.Minute)),
+		waiter(3, start.Add(5*time.Minute)),
+		waiter(4, start.Add(2*time.Minute)),
+	})
+	if next, ok := w.Next(); !ok || !next.Equal(start.Add(time.Minute)) {
+		t.Errorf("Next() = %s, %t, want the earliest expiry", next, ok)
+	}
+	if got := expiredIds(w, start); len(got) != 0 {
+		t.Errorf("expired %v before any wait ran out", got)
+	}
+	if got := expiredIds(w, start.Add(3*time.Minute)); !sameIds(got, 2, 4, 1) {
+		t.Errorf("expired %v, want 2, 4 then 1", got)
+	}
+	if w.Len() != 1 {
+		t.Errorf("%d waiters timed, want the one yet to expire", w.Len())
+	}
+}
+
+func TestWaitTimersReschedule(t *testing.T) {
+	start := time.Unix(1000, 0).UTC()
+	w := NewWaitTimers()
+	w.Sync([]swagger.WaiterStatus{waiter(1, start.Add(time.Minute)), waiter(2, start.Add(2*time.Minute))})
+	// waiter 1 extends their wait, replacing rather than adding a timer
+	w.Sync([]swagger.WaiterStatus{waiter(1, start.Add(3*time.Minute)), waiter(2, start.Add(2*time.Minute))})
+	if w.Len() != 2 {
+		t.Fatalf("%d waiters timed after a reschedule, want 2", w.Len())
+	}
+	if got := expiredIds(w, start.Add(2*time.Minute)); !sameIds(got, 2) {
+		t.Errorf("expired %v, want only 2 with 1's wait extended", got)
+	}
+	if got := expiredIds(w, start.Add(3*time.Minute)); !sameIds(got, 1) {
+		t.Errorf("expired %v, want 1 at its new expiry", got)
+	}
+}
+
+func TestWaitTimersEndedWaits(t *testing.T) {
+	start := time.Unix(1000, 0).UTC()
+	w := NewWaitTimers()
+	listed := []swagger.WaiterStatus{waiter(1, start.Add(time.Minute)), waiter(2, start.Add(time.Hour))}
+	w.Sync(listed)
+	if got := expiredIds(w, start.Add(time.Minute)); !sameIds(got, 1) {
+		t.Fatalf("expired %v, want 1", got)
+	}
+	// Parvati still lists the ended wait until the update lands
+	w.Sync(listed)
+	if got := expiredIds(w, start.Add(2*time.Minute)); len(got) != 0 {
+		t.Errorf("ended wait expired again: %v", got)
+	}
+	// failed to end, so tried again
+	w.Retry(listed[0], start.Add(3*time.Minute))
+	if got := expiredIds(w, start.Add(3*time.Minute)); !sameIds(got, 1) {
+		t.Errorf("expired %v, want the retried wait", got)
+	}
+	// extended after being ended, so timed again
+	w.Sync([]swagger.WaiterStatus{waiter(1, start.Add(10*time.Minute)), listed[1]})
+	if got := expiredIds(w, start.Add(10*time.Minute)); !sameIds(got, 1) {
+		t.Errorf("expired %v, want the extended wait", got)
+	}
+	// no longer listed, so forgotten
+	w.Sync(nil)
+	if w.Len() != 0 {
+		t.Errorf("%d waiters timed with none listed", w.Len())
+	}
+	if _, ok := w.Next(); ok {
+		t.Error("Next() found a wait with none listed")
+	}
+}
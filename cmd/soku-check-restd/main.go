@@ -11,8 +11,6 @@
 package main
 
 import (
-	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
@@ -23,6 +21,9 @@ import (
 	"github.com/go-resty/resty/v2"
 	"github.com/jessevdk/go-flags"
 
+	"github.com/misatosangel/parvati-soku-checker/pkg/geoip"
+	"github.com/misatosangel/parvati-soku-checker/pkg/logging"
+	"github.com/misatosangel/parvati-soku-checker/pkg/netguard"
 	"github.com/misatosangel/parvati-soku-checker/pkg/pretty"
 	"github.com/misatosangel/soku-cardinfo/pkg/card-info"
 	"github.com/misatosangel/soku-net-checker/pkg/checker"
@@ -34,8 +35,25 @@ var settings struct {
 	AuthCheck string `short:"a" long:"auth-url" description:"Auth to check credentials against"`
 	Live      bool   `short:"r" long:"release" description:"Run in release mode"`
 	CardInfo  string `long:"cards" required:"true" description:"Location of a CSV cards file to read."`
+
+	Probes  netguard.Options `group:"Probe limits"`
+	GeoIP   geoip.Options    `group:"GeoIP"`
+	Logging logging.Options  `group:"Logging"`
 }
 
+// Loggers for each component, see --log-component
+var (
+	mainLog = logging.New("main")
+	httpLog = logging.New("http")
+	authLog = logging.New("auth")
+)
+
+// Limits where and how fast hosts are probed
+var guard *netguard.Guard
+
+// Where host and opponent addresses are from, nil if not configured
+var geo *geoip.DB
+
 func init() {
 }
 
@@ -46,25 +64,41 @@ func main() {
 func run() int {
 	CliParse()
 
+	g, err := settings.Probes.Guard()
+	if err != nil {
+		mainLog.Fatal("Bad probe limits", "error", err)
+	}
+	guard = g
+
+	geo, err = settings.GeoIP.Open()
+	if err != nil {
+		mainLog.Fatal("Unable to open GeoIP database", "error", err)
+	}
+	defer geo.Close()
+
 	csvFile, err := os.Open(settings.CardInfo)
 	if err != nil {
-		log.Fatal("Unable to open card data CSV file:", err)
+		mainLog.Fatal("Unable to open card data CSV file", "path", settings.CardInfo, "error", err)
 	}
 	allCards, err := cardinfo.NewFromCSV(csvFile)
 	if err != nil {
-		log.Fatal("Unable to read card data CSV file:", err)
+		mainLog.Fatal("Unable to read card data CSV file", "path", settings.CardInfo, "error", err)
 	}
 
 	if settings.Live {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	router := gin.Default()
+	router := newRouter(allCards)
+	router.Run(settings.BindAddr)
+	return 0
+}
+
+// The routes served, each probe going through the guard
+func newRouter(allCards cardinfo.AllCards) *gin.Engine {
+	router := gin.New()
+	router.Use(requestLogger(), gin.Recovery())
 	//mainLogger := log.New( os.Stderr, "Httpd: ", log.Ldate | log.Lmicroseconds )
-	if err != nil {
-		fmt.Println(err.Error())
-		return 1
-	}
 	authorized := router.Group("/check", basicAuth(settings.AuthCheck))
 
 	// simplest ping check - is the host up?
@@ -74,6 +108,9 @@ func run() int {
 			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 			return
 		}
+		if !allowProbe(c, request) {
+			return
+		}
 		start := time.Now()
 		up, err := request.IsUp()
 		duration := time.Since(start)
@@ -103,6 +140,16 @@ func run() int {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown check level: '" + toPoint + "'\n"})
 			return
 		}
+		if state > checker.STATE_BASIC {
+			// spectating follows redirects the guard cannot see
+			if err := guard.Redirects(); err != nil {
+				respondWithError(http.StatusForbidden, err.Error(), c)
+				return
+			}
+		}
+		if !allowProbe(c, request) {
+			return
+		}
 		var result checker.CheckResult
 		if roll == "" {
 			result = request.Check(state, false)
@@ -112,29 +159,29 @@ func run() int {
 		if !canSeeOpponentIP(c) { // hide remote IP
 			result.Opponent = ""
 		}
+		resp := gin.H{
+			"request":  request.OriginalAddr,
+			"hostport": request.Address,
+			"result":   result,
+		}
 		switch strings.ToLower(c.Query("pretty")) {
 		case "y", "yes", "t", "true", "on", "1":
-			c.JSON(http.StatusOK, gin.H{
-				"request":  request.OriginalAddr,
-				"hostport": request.Address,
-				"result":   pretty.MarkupResult(result, allCards),
-			})
-		default:
-			c.JSON(http.StatusOK, gin.H{
-				"request":  request.OriginalAddr,
-				"hostport": request.Address,
-				"result":   result,
-			})
+			resp["result"] = pretty.MarkupResult(result, allCards)
 		}
+		if loc := geo.Lookup(request.Address); loc != nil {
+			resp["host_geo"] = loc
+		}
+		if loc := geo.Lookup(result.Opponent); loc != nil { // only set if they can see it
+			resp["opponent_geo"] = loc
+		}
+		c.JSON(http.StatusOK, resp)
 
 	})
 
 	router.GET("/info", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{"card-info": settings.CardInfo, "release": settings.Live})
 	})
-
-	router.Run(settings.BindAddr)
-	return 0
+	return router
 }
 
 func canSeeOpponentIP(c *gin.Context) bool {
@@ -146,7 +193,7 @@ func basicAuth(checkUrl string) gin.HandlerFunc {
 		authHdr := c.Request.Header.Get("Authorization")
 		remoteIP := c.ClientIP()
 		if authHdr == "" {
-			log.Printf("[Auth] %s - anonymous", remoteIP)
+			authLog.Debug("Anonymous request", "client", remoteIP)
 			c.Next()
 			return
 		}
@@ -167,12 +214,12 @@ func basicAuth(checkUrl string) gin.HandlerFunc {
 		response, err := request.Get(checkUrl)
 		if err != nil || !response.IsSuccess() {
 			if err != nil {
-				log.Printf("[Auth] %s - Backend Auth Proxy Down - %s\n", remoteIP, err.Error())
+				authLog.Error("Backend auth proxy down", "client", remoteIP, "error", err)
 				respondWithError(500, "Backend Auth Proxy Down", c)
 				return
 			}
 			if response.StatusCode() >= 500 {
-				log.Printf("[Auth] %s - Backend Auth Proxy Down? - %s\n", remoteIP, response.Status())
+				authLog.Error("Backend auth proxy down?", "client", remoteIP, "status", response.Status())
 				respondWithError(500, "Backend Auth Proxy Down", c)
 				return
 			}
@@ -190,11 +237,38 @@ func basicAuth(checkUrl string) gin.HandlerFunc {
 			canSeeOpponents = result.Privs == "super"
 		}
 		c.Set("CanSeeOp", canSeeOpponents)
-		log.Printf("[Auth] %s - %s (%d) %s VisibleOpponent: %t\n", remoteIP, result.Nick, result.Id, result.Privs, canSeeOpponents)
+		authLog.Info("Authorised", "client", remoteIP, "user", result.Nick, "user_id", result.Id, "privs", result.Privs, "see_opponent", canSeeOpponents)
 		c.Next()
 	}
 }
 
+// Responds with an error and returns false if the request may not be probed
+// now, either because of where it is going or the probe rate limits.
+func allowProbe(c *gin.Context, request *checker.Request) bool {
+	switch err := guard.Allow(request.Address); err {
+	case nil:
+		return true
+	case netguard.ErrDenied:
+		respondWithError(http.StatusForbidden, err.Error(), c)
+	case netguard.ErrRateLimited:
+		c.Header("Retry-After", "1")
+		respondWithError(http.StatusTooManyRequests, err.Error(), c)
+	default:
+		respondWithError(http.StatusBadRequest, err.Error(), c)
+	}
+	return false
+}
+
+// Logs each request once it has been handled, in place of gin's logger
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		httpLog.Info("Request", "method", c.Request.Method, "path", c.Request.URL.Path, "status", c.Writer.Status(),
+			"client", c.ClientIP(), "duration", time.Since(start))
+	}
+}
+
 func respondWithError(code int, message string, c *gin.Context) {
 	resp := map[string]string{"error": message}
 
@@ -213,21 +287,24 @@ func CliParse() {
 				os.Exit(0)
 			}
 		}
-		log.Fatalln(err)
+		mainLog.Fatal("Bad command line", "error", err)
 	}
 	if len(args) != 0 {
-		log.Fatalln("Passed unexpected extra command line arguments, use -h for help")
+		mainLog.Fatal("Passed unexpected extra command line arguments, use -h for help")
+	}
+	if err := settings.Logging.Apply(); err != nil {
+		mainLog.Fatal("Bad logging settings", "error", err)
 	}
 
 	if settings.AuthCheck != "" {
 		authUrl, err := url.Parse(settings.AuthCheck)
 		if err != nil {
-			log.Fatalln(err)
+			mainLog.Fatal("Bad auth URL", "url", settings.AuthCheck, "error", err)
 		}
 		if authUrl.Hostname() == "" {
-			log.Fatalf("Cannot parse '%s' as a valid URL", settings.AuthCheck)
+			mainLog.Fatal("Cannot parse auth URL as a valid URL", "url", settings.AuthCheck)
 		}
 		settings.AuthCheck = authUrl.String()
-		log.Printf("Attempting to auth requests via %s", settings.AuthCheck)
+		authLog.Info("Attempting to auth requests", "url", settings.AuthCheck)
 	}
 }
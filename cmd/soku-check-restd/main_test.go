@@ -0,0 +1,153 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/misatosangel/parvati-soku-checker/pkg/fakesoku"
+	"github.com/misatosangel/parvati-soku-checker/pkg/netguard"
+	"github.com/misatosangel/soku-cardinfo/pkg/card-info"
+)
+
+// A router whose guard lets probes reach fake hosts on the loopback address
+func testRouter(t *testing.T, redirects bool) http.Handler {
+	g, err := netguard.New(nil, []string{"127.0.0.1/32"}, netguard.Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.FollowRedirects = redirects
+	old := guard
+	guard = g
+	t.Cleanup(func() { guard = old })
+	gin.SetMode(gin.TestMode)
+	var cards cardinfo.AllCards
+	return newRouter(cards)
+}
+
+func fakeHost(t *testing.T, state fakesoku.State) *fakesoku.Host {
+	config := fakesoku.DefaultConfig()
+	config.State = state
+	host, err := fakesoku.Listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { host.Close() })
+	return host
+}
+
+// Requests the path, decoding the JSON response into body
+func get(t *testing.T, router http.Handler, path string, body interface{}) int {
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	if body != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), body); err != nil {
+			t.Fatalf("GET %s: bad JSON %q: %s", path, rec.Body.String(), err)
+		}
+	}
+	return rec.Code
+}
+
+// Spectating follows redirects to hosts which never pass the guard, so is
+// refused before anything is sent unless allowed
+func TestCheckLevelNeedsRedirects(t *testing.T) {
+	host := fakeHost(t, fakesoku.Playing)
+	router := testRouter(t, false)
+	for _, level := range []string{"state", "full"} {
+		if code := get(t, router, "/check/"+host.Addr()+"?level="+level, nil); code != http.StatusForbidden {
+			t.Errorf("level=%s check = %d, want 403 without --probe-follow-redirects", level, code)
+		}
+	}
+	if host.Received() != 0 {
+		t.Errorf("refused checks sent %d packets", host.Received())
+	}
+	if code := get(t, router, "/check/"+host.Addr()+"?level=basic", nil); code != http.StatusOK {
+		t.Errorf("level=basic check = %d, want 200", code)
+	}
+	router = testRouter(t, true)
+	if code := get(t, router, "/check/"+host.Addr()+"?level=state", nil); code != http.StatusOK {
+		t.Errorf("level=state check = %d, want 200 with --probe-follow-redirects", code)
+	}
+}
+
+func TestDeniedAddress(t *testing.T) {
+	router := testRouter(t, true)
+	for _, path := range []string{"/ping/10.0.0.1:10800", "/check/10.0.0.1:10800", "/check/127.0.0.2:10800?level=state"} {
+		if code := get(t, router, path, nil); code != http.StatusForbidden {
+			t.Errorf("GET %s = %d, want 403", path, code)
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	router := testRouter(t, false)
+	up, down := fakeHost(t, fakesoku.Waiting), fakeHost(t, fakesoku.Down)
+	for _, tt := range []struct {
+		host *fakesoku.Host
+		up   bool
+	}{{up, true}, {down, false}} {
+		var body struct {
+			Request  string `json:"request"`
+			HostPort string `json:"hostport"`
+			Up       bool   `json:"up"`
+		}
+		if code := get(t, router, "/ping/"+tt.host.Addr(), &body); code != http.StatusOK {
+			t.Fatalf("GET /ping = %d, want 200", code)
+		}
+		if body.Up != tt.up || body.HostPort != tt.host.Addr() {
+			t.Errorf("GET /ping/%s = %+v, want up %t", tt.host.Addr(), body, tt.up)
+		}
+	}
+	if code := get(t, router, "/ping/not-an-address", nil); code != http.StatusBadRequest {
+		t.Errorf("GET /ping of a bad address = %d, want 400", code)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	router := testRouter(t, true)
+	waiting := fakeHost(t, fakesoku.Waiting)
+	roll := fakesoku.DefaultConfig()
+	roll.AnyId = true
+	rolled, err := fakesoku.Listen("127.0.0.1:0", roll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rolled.Close()
+	for _, tt := range []struct {
+		name string
+		path string
+		up   bool
+	}{
+		{"basic", "/check/" + waiting.Addr(), true},
+		{"state", "/check/" + waiting.Addr() + "?level=state", true},
+		{"full", "/check/" + waiting.Addr() + "?level=full&pretty=1", true},
+		{"sokuroll", "/check/" + rolled.Addr() + "?version=1.3", true},
+		{"down", "/check/" + fakeHost(t, fakesoku.Down).Addr(), false},
+	} {
+		var body struct {
+			HostPort string `json:"hostport"`
+			Result   struct {
+				Address string `json:"address"`
+				Status  string `json:"status"`
+			} `json:"result"`
+		}
+		if code := get(t, router, tt.path, &body); code != http.StatusOK {
+			t.Errorf("%s: GET %s = %d, want 200", tt.name, tt.path, code)
+			continue
+		}
+		if body.HostPort == "" || (body.Result.Status == "Waiting") != tt.up {
+			t.Errorf("%s: GET %s = %+v, want Waiting %t", tt.name, tt.path, body, tt.up)
+		}
+	}
+	if len(rolled.GameIdsSeen()) == 0 {
+		t.Error("sokuroll check never asked the host for a game id")
+	}
+	if code := get(t, router, "/check/"+waiting.Addr()+"?level=deepest", nil); code != http.StatusBadRequest {
+		t.Errorf("GET /check at an unknown level = %d, want 400", code)
+	}
+}
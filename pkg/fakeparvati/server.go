@@ -0,0 +1,263 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+// Package fakeparvati provides a local stand-in for the parts of Parvati's
+// API used by the poller: the games list, a game's host list and waiters,
+// and host status / wait time updates. Updates received are recorded so
+// they can be inspected afterwards.
+//
+// Nothing is persisted and no credentials are checked.
+package fakeparvati
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/misatosangel/parvati-api-client/pkg/parvatigo"
+	"github.com/misatosangel/parvati-api-client/pkg/swagger"
+)
+
+// Base path all routes are served under
+const ApiBase = "/api/v1"
+
+// A host status update received by the server
+type Update struct {
+	Game     string                 `json:"game"`
+	HosterId int64                  `json:"hoster_id"`
+	CheckId  int64                  `json:"check_id"`
+	Received time.Time              `json:"received"`
+	Status   parvatigo.StatusUpdate `json:"status"`
+}
+
+// A wait time update received by the server
+type WaitUpdate struct {
+	Game     string    `json:"game"`
+	UserId   int64     `json:"user_id"`
+	Minutes  int       `json:"minutes"`
+	Message  string    `json:"message,omitempty"`
+	Received time.Time `json:"received"`
+}
+
+// The host list and waiters for a game
+type List struct {
+	Hosts []swagger.HosterStatus `json:"hosts"`
+	Waits []swagger.WaiterStatus `json:"waits"`
+}
+
+type Server struct {
+	lock        sync.Mutex
+	games       []swagger.Game
+	lists       map[string]*List // by game short name
+	updates     []Update
+	waitUpdates []WaitUpdate
+	lastCheckId int64
+}
+
+func New() *Server {
+	return &Server{lists: make(map[string]*List)}
+}
+
+// Adds a game to the games list, with an empty host list
+func (s *Server) AddGame(game swagger.Game) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.games = append(s.games, game)
+	if _, ok := s.lists[game.UrlShortName]; !ok {
+		s.lists[game.UrlShortName] = &List{}
+	}
+}
+
+// Replaces the listed hosts for a game
+func (s *Server) SetHosts(game string, hosts []swagger.HosterStatus) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.list(game).Hosts = append([]swagger.HosterStatus(nil), hosts...)
+}
+
+// Replaces the listed waiters for a game
+func (s *Server) SetWaits(game string, waits []swagger.WaiterStatus) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.list(game).Waits = append([]swagger.WaiterStatus(nil), waits...)
+}
+
+// All host status updates received so far, oldest first
+func (s *Server) Updates() []Update {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]Update(nil), s.updates...)
+}
+
+// All wait time updates received so far, oldest first
+func (s *Server) WaitUpdates() []WaitUpdate {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]WaitUpdate(nil), s.waitUpdates...)
+}
+
+// Forgets all updates received so far
+func (s *Server) ResetUpdates() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.updates = nil
+	s.waitUpdates = nil
+}
+
+// Starts serving on a random local port, the caller must Close the returned
+// server. Its URL plus ApiBase is the URI to give the API client.
+func (s *Server) Start() *httptest.Server {
+	return httptest.NewServer(s.Handler())
+}
+
+// The HTTP handler serving the fake API
+func (s *Server) Handler() http.Handler {
+	router := gin.New()
+	api := router.Group(ApiBase)
+	api.GET("/games", s.getGames)
+	api.GET("/games/:game/hostlist", s.getList)
+	api.POST("/games/:game/hosts/:id/checks", s.postCheck)
+	api.PUT("/games/:game/waits/:user", s.putWait)
+	router.GET("/fake/updates", s.getUpdates)
+	return router
+}
+
+// Not part of Parvati, lets whoever is driving the fake see what it received
+func (s *Server) getUpdates(c *gin.Context) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c.JSON(http.StatusOK, gin.H{"updates": s.updates, "wait_updates": s.waitUpdates})
+}
+
+func (s *Server) getGames(c *gin.Context) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c.JSON(http.StatusOK, s.games)
+}
+
+func (s *Server) getList(c *gin.Context) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list, ok := s.lists[c.Param("game")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No such game"})
+		return
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+func (s *Server) postCheck(c *gin.Context) {
+	hosterId, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad host id"})
+		return
+	}
+	var su parvatigo.StatusUpdate
+	if err := c.ShouldBindJSON(&su); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list, ok := s.lists[c.Param("game")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No such game"})
+		return
+	}
+	for i := range list.Hosts {
+		hs := &list.Hosts[i]
+		if hs.Host.BaseInfo.Id != hosterId {
+			continue
+		}
+		s.lastCheckId++
+		s.updates = append(s.updates, Update{
+			Game:     c.Param("game"),
+			HosterId: hosterId,
+			CheckId:  s.lastCheckId,
+			Received: time.Now(),
+			Status:   su,
+		})
+		applyUpdate(hs, s.lastCheckId, &su)
+		c.JSON(http.StatusOK, hs.Status)
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "No such host"})
+}
+
+func (s *Server) putWait(c *gin.Context) {
+	userId, err := strconv.ParseInt(c.Param("user"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Bad user id"})
+		return
+	}
+	var req struct {
+		Minutes int    `json:"minutes"`
+		Message string `json:"message"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	list, ok := s.lists[c.Param("game")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No such game"})
+		return
+	}
+	s.waitUpdates = append(s.waitUpdates, WaitUpdate{
+		Game:     c.Param("game"),
+		UserId:   userId,
+		Minutes:  req.Minutes,
+		Message:  req.Message,
+		Received: time.Now(),
+	})
+	if req.Minutes <= 0 { // waiting terminated
+		kept := list.Waits[:0]
+		for _, ws := range list.Waits {
+			if ws.Waiter.User.Id != userId {
+				kept = append(kept, ws)
+			}
+		}
+		list.Waits = kept
+	}
+	c.JSON(http.StatusOK, gin.H{})
+}
+
+// call with the lock held
+func (s *Server) list(game string) *List {
+	list, ok := s.lists[game]
+	if !ok {
+		list = &List{}
+		s.lists[game] = list
+	}
+	return list
+}
+
+// Makes the listed status of the host reflect the update
+func applyUpdate(hs *swagger.HosterStatus, checkId int64, su *parvatigo.StatusUpdate) {
+	hs.Status.Id = checkId
+	hs.Status.Status = su.Status
+	hs.Status.CanSpec = "unknown"
+	if su.CanSpec != nil {
+		if *su.CanSpec {
+			hs.Status.CanSpec = "yes"
+		} else {
+			hs.Status.CanSpec = "no"
+		}
+	}
+	if su.NewVers != nil {
+		hs.Status.Version = *su.NewVers
+	}
+	hs.Status.P1Profile = ""
+	hs.Status.P2Profile = ""
+	if su.Prof1Name != nil {
+		hs.Status.P1Profile = *su.Prof1Name
+	}
+	if su.Prof2Name != nil {
+		hs.Status.P2Profile = *su.Prof2Name
+	}
+}
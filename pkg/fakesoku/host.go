@@ -0,0 +1,319 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+// Package fakesoku provides a scriptable local UDP stand-in for a
+// hisoutensoku host, answering the handshake and spectator packets a
+// checker sends so checks can be exercised with no real game running.
+//
+// Only the subset of the netplay protocol needed to answer probes is spoken:
+// HELLO is answered with OLLEH, INIT_REQUEST with INIT_SUCCESS or INIT_ERROR
+// depending on the configured state, and once spectating a GAME_MATCH_REQUEST
+// is answered with the configured match.
+package fakesoku
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Packet types
+const (
+	PacketHello       = 0x01
+	PacketOlleh       = 0x03
+	PacketInitRequest = 0x05
+	PacketInitSuccess = 0x06
+	PacketInitError   = 0x07
+	PacketQuit        = 0x0b
+	PacketHostGame    = 0x0d
+	PacketClientGame  = 0x0e
+)
+
+// Game packet types carried in HOST_GAME / CLIENT_GAME
+const (
+	GameMatch        = 0x04
+	GameMatchRequest = 0x08
+)
+
+// INIT_REQUEST request types
+const (
+	RequestSpectate = 0x00
+	RequestPlay     = 0x01
+)
+
+// INIT_ERROR reasons
+const (
+	ErrSpectateDisabled = 0
+	ErrGameInProgress   = 1
+	ErrWrongVersion     = 2
+)
+
+// Game id sent by an unmodified hisoutensoku v1.10a. Sokuroll alters the id
+// per version, so pass whatever id a given roll version uses in Config.
+var GameId110a = [16]byte{0x6e, 0x73, 0x65, 0xd9, 0xff, 0xc4, 0x6e, 0x48, 0x8d, 0x7c, 0xa1, 0x92, 0x31, 0x34, 0x72, 0x95}
+
+// Game ids by version name, as accepted by ParseGameId. Add the ids of any
+// sokuroll versions to be faked; a host with Config.AnyId lists those a
+// checker sent in GameIdsSeen.
+var GameIds = map[string][16]byte{
+	"1.10a": GameId110a,
+}
+
+// Parses a game id given as a version name in GameIds or as 16 bytes of
+// hex, which may be split up by spaces, dashes or colons and start with 0x
+func ParseGameId(s string) ([16]byte, error) {
+	var id [16]byte
+	if known, ok := GameIds[strings.ToLower(s)]; ok {
+		return known, nil
+	}
+	digits := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "0x")
+	digits = strings.NewReplacer(" ", "", "-", "", ":", "", "{", "", "}", "").Replace(digits)
+	raw, err := hex.DecodeString(digits)
+	if err != nil || len(raw) != len(id) {
+		return id, fmt.Errorf("'%s' is not a known version or 16 bytes of hex", s)
+	}
+	copy(id[:], raw)
+	return id, nil
+}
+
+type State int
+
+const (
+	Down    State = iota // never answers
+	Waiting              // hosting, waiting for an opponent
+	Playing              // in a match
+)
+
+func (s State) String() string {
+	switch s {
+	case Waiting:
+		return "waiting"
+	case Playing:
+		return "playing"
+	}
+	return "down"
+}
+
+// One side of a match
+type Player struct {
+	Character uint8
+	Palette   uint8
+	DeckId    uint8
+	Deck      []uint16
+}
+
+// How the fake host behaves
+type Config struct {
+	State    State
+	Spectate bool      // whether spectators are accepted while playing
+	GameId   [16]byte  // only INIT_REQUESTs with this id are accepted
+	AnyId    bool      // accept INIT_REQUESTs with any game id
+	Profiles [2]string // host and client profile names
+	Players  [2]Player
+	Stage    uint8
+	Music    uint8
+	Seed     uint32
+	MatchId  uint8
+}
+
+// A config for a plain v1.10a host waiting for an opponent
+func DefaultConfig() Config {
+	return Config{
+		State:    Waiting,
+		Spectate: true,
+		GameId:   GameId110a,
+		Profiles: [2]string{"host", "client"},
+	}
+}
+
+type Host struct {
+	conn *net.UDPConn
+
+	lock     sync.Mutex
+	config   Config
+	drop     int // number of incoming packets still to ignore
+	received int
+	ids      [][16]byte // game ids INIT_REQUESTs have asked for, in the order first seen
+}
+
+// Starts a fake host listening on the given UDP address, e.g. 127.0.0.1:0
+// for any free port. The caller must Close it.
+func Listen(addr string, config Config) (*Host, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	h := &Host{conn: conn, config: config}
+	go h.serve()
+	return h, nil
+}
+
+// The address actually listened on
+func (h *Host) Addr() string {
+	return h.conn.LocalAddr().String()
+}
+
+func (h *Host) Close() error {
+	return h.conn.Close()
+}
+
+func (h *Host) Config() Config {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.config
+}
+
+// Changes how the host behaves from the next packet on
+func (h *Host) SetConfig(config Config) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.config = config
+}
+
+// Silently ignores the next n packets, as if they were lost
+func (h *Host) Drop(n int) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.drop = n
+}
+
+// Number of packets received so far, including dropped ones
+func (h *Host) Received() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.received
+}
+
+// The game ids INIT_REQUESTs have asked for, e.g. to find the id a checker
+// sends for a sokuroll version with Config.AnyId
+func (h *Host) GameIdsSeen() [][16]byte {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return append([][16]byte(nil), h.ids...)
+}
+
+func (h *Host) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := h.conn.ReadFromUDP(buf)
+		if err != nil {
+			return // closed
+		}
+		h.lock.Lock()
+		h.received++
+		if n >= 17 && buf[0] == PacketInitRequest {
+			h.sawId(buf[1:17])
+		}
+		config := h.config
+		dropped := h.drop > 0
+		if dropped {
+			h.drop--
+		}
+		h.lock.Unlock()
+		if dropped || n == 0 || config.State == Down {
+			continue
+		}
+		reply := Reply(&config, buf[:n])
+		if reply != nil {
+			h.conn.WriteToUDP(reply, from)
+		}
+	}
+}
+
+// call with the lock held
+func (h *Host) sawId(raw []byte) {
+	var id [16]byte
+	copy(id[:], raw)
+	for _, seen := range h.ids {
+		if seen == id {
+			return
+		}
+	}
+	h.ids = append(h.ids, id)
+}
+
+// Works out the reply a host with the given config makes to a packet, nil
+// if it would not reply.
+func Reply(config *Config, packet []byte) []byte {
+	if len(packet) == 0 {
+		return nil
+	}
+	switch packet[0] {
+	case PacketHello:
+		return []byte{PacketOlleh}
+	case PacketInitRequest:
+		return initReply(config, packet)
+	case PacketClientGame:
+		if len(packet) > 1 && packet[1] == GameMatchRequest && config.State == Playing && config.Spectate {
+			return matchPacket(config)
+		}
+	}
+	return nil
+}
+
+// INIT_REQUEST: type, game id[16], unknown[8], request type, ...
+func initReply(config *Config, packet []byte) []byte {
+	if len(packet) < 26 {
+		return nil
+	}
+	if !config.AnyId && !bytes.Equal(packet[1:17], config.GameId[:]) {
+		return initError(ErrWrongVersion)
+	}
+	switch packet[25] {
+	case RequestPlay:
+		if config.State == Playing {
+			return initError(ErrGameInProgress)
+		}
+		return initSuccess(config)
+	case RequestSpectate:
+		if config.State != Playing {
+			return initError(ErrGameInProgress) // nothing to watch yet
+		}
+		if !config.Spectate {
+			return initError(ErrSpectateDisabled)
+		}
+		return initSuccess(config)
+	}
+	return nil
+}
+
+func initError(reason uint32) []byte {
+	out := make([]byte, 5)
+	out[0] = PacketInitError
+	binary.LittleEndian.PutUint32(out[1:], reason)
+	return out
+}
+
+// INIT_SUCCESS: type, unknown[8], data size, host profile[32], client profile[32], swr disabled
+func initSuccess(config *Config) []byte {
+	out := make([]byte, 1+8+4+32+32+4)
+	out[0] = PacketInitSuccess
+	binary.LittleEndian.PutUint32(out[9:], 68)
+	copy(out[13:45], config.Profiles[0])
+	copy(out[45:77], config.Profiles[1])
+	return out
+}
+
+// HOST_GAME carrying GAME_MATCH: both players, stage, music, seed and match id
+func matchPacket(config *Config) []byte {
+	out := []byte{PacketHostGame, GameMatch}
+	for _, p := range config.Players {
+		out = append(out, p.Character, p.Palette, p.DeckId, uint8(len(p.Deck)))
+		for _, card := range p.Deck {
+			out = append(out, byte(card), byte(card>>8))
+		}
+		out = append(out, 0) // simultaneous buttons not disabled
+	}
+	seed := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seed, config.Seed)
+	out = append(out, config.Stage, config.Music)
+	out = append(out, seed...)
+	return append(out, config.MatchId)
+}
@@ -0,0 +1,199 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package fakesoku
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/misatosangel/soku-net-checker/pkg/checker"
+)
+
+func initRequest(id [16]byte, kind byte) []byte {
+	packet := make([]byte, 26+4)
+	packet[0] = PacketInitRequest
+	copy(packet[1:17], id[:])
+	packet[25] = kind
+	return packet
+}
+
+func withState(state State, spectate bool) *Config {
+	config := DefaultConfig()
+	config.State = state
+	config.Spectate = spectate
+	return &config
+}
+
+func TestReply(t *testing.T) {
+	otherId := GameId110a
+	otherId[15]++
+	anyId := withState(Waiting, true)
+	anyId.AnyId = true
+	matchRequest := []byte{PacketClientGame, GameMatchRequest}
+	for _, tt := range []struct {
+		name   string
+		config *Config
+		packet []byte
+		want   []byte
+	}{
+		{"empty", withState(Waiting, true), nil, nil},
+		{"hello", withState(Waiting, true), []byte{PacketHello}, []byte{PacketOlleh}},
+		{"unknown packet", withState(Waiting, true), []byte{PacketQuit}, nil},
+		{"short init", withState(Waiting, true), initRequest(GameId110a, RequestPlay)[:25], nil},
+		{"wrong version", withState(Waiting, true), initRequest(otherId, RequestPlay), initError(ErrWrongVersion)},
+		{"any version", anyId, initRequest(otherId, RequestPlay), initSuccess(anyId)},
+		{"play waiting", withState(Waiting, true), initRequest(GameId110a, RequestPlay), initSuccess(withState(Waiting, true))},
+		{"play playing", withState(Playing, true), initRequest(GameId110a, RequestPlay), initError(ErrGameInProgress)},
+		{"spectate waiting", withState(Waiting, true), initRequest(GameId110a, RequestSpectate), initError(ErrGameInProgress)},
+		{"spectate refused", withState(Playing, false), initRequest(GameId110a, RequestSpectate), initError(ErrSpectateDisabled)},
+		{"spectate playing", withState(Playing, true), initRequest(GameId110a, RequestSpectate), initSuccess(withState(Playing, true))},
+		{"unknown request", withState(Waiting, true), initRequest(GameId110a, 7), nil},
+		{"match playing", withState(Playing, true), matchRequest, matchPacket(withState(Playing, true))},
+		{"match refused", withState(Playing, false), matchRequest, nil},
+		{"match waiting", withState(Waiting, true), matchRequest, nil},
+	} {
+		if got := Reply(tt.config, tt.packet); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: Reply() = % x, want % x", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInitSuccessLayout(t *testing.T) {
+	config := DefaultConfig()
+	config.Profiles = [2]string{"alice", "bob"}
+	got := initSuccess(&config)
+	if len(got) != 81 || got[0] != PacketInitSuccess {
+		t.Fatalf("initSuccess() = % x, want an 81 byte INIT_SUCCESS", got)
+	}
+	if size := binary.LittleEndian.Uint32(got[9:]); size != 68 {
+		t.Errorf("data size %d, want 68", size)
+	}
+	if p1 := string(bytes.TrimRight(got[13:45], "\x00")); p1 != "alice" {
+		t.Errorf("host profile %q, want alice", p1)
+	}
+	if p2 := string(bytes.TrimRight(got[45:77], "\x00")); p2 != "bob" {
+		t.Errorf("client profile %q, want bob", p2)
+	}
+}
+
+func TestMatchPacketLayout(t *testing.T) {
+	config := DefaultConfig()
+	config.Players[0] = Player{Character: 3, Palette: 1, DeckId: 2, Deck: []uint16{100, 201}}
+	config.Stage, config.Music, config.Seed, config.MatchId = 5, 6, 0x01020304, 9
+	want := []byte{PacketHostGame, GameMatch,
+		3, 1, 2, 2, 100, 0, 201, 0, 0,
+		0, 0, 0, 0, 0,
+		5, 6, 4, 3, 2, 1, 9}
+	if got := matchPacket(&config); !bytes.Equal(got, want) {
+		t.Errorf("matchPacket() = % x, want % x", got, want)
+	}
+}
+
+func TestParseGameId(t *testing.T) {
+	for _, s := range []string{
+		"1.10a",
+		"6e7365d9ffc46e488d7ca19231347295",
+		"0x6E7365D9FFC46E488D7CA19231347295",
+		"6e 73 65 d9 ff c4 6e 48 8d 7c a1 92 31 34 72 95",
+		"6e7365d9-ffc4-6e48-8d7c-a19231347295",
+	} {
+		if id, err := ParseGameId(s); err != nil || id != GameId110a {
+			t.Errorf("ParseGameId(%q) = % x, %v, want the v1.10a id", s, id, err)
+		}
+	}
+	for _, s := range []string{"", "1.10b", "6e7365d9", "zz7365d9ffc46e488d7ca19231347295"} {
+		if _, err := ParseGameId(s); err == nil {
+			t.Errorf("ParseGameId(%q) succeeded, want an error", s)
+		}
+	}
+}
+
+func checkLevel(t *testing.T, config Config, level string) checker.CheckResult {
+	host, err := Listen("127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	to, err := checker.ParseToState(level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := checker.NewRequest(host.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Timeout = 500 * time.Millisecond
+	result := req.Check(to, false)
+	if host.Received() == 0 {
+		t.Errorf("%s check of a %s host sent nothing", level, config.State)
+	}
+	return result
+}
+
+// Checks a real checker request against the fake at each level
+func TestCheckerLevels(t *testing.T) {
+	playing := DefaultConfig()
+	playing.State = Playing
+	playing.Players[0] = Player{Character: 2, Deck: []uint16{100, 101}}
+	playing.Players[1] = Player{Character: 4}
+	for _, level := range []string{"basic", "state", "full"} {
+		if result := checkLevel(t, DefaultConfig(), level); !result.GoodStatus() {
+			t.Errorf("%s check of a waiting host = %s, want it up", level, result)
+		}
+		result := checkLevel(t, playing, level)
+		if !result.GoodStatus() {
+			t.Errorf("%s check of a playing host = %s, want it up", level, result)
+		}
+		if level == "full" {
+			if result.CurGame == nil || len(result.CurGame.Players) != 2 || result.CurGame.Players[0].Char != 2 {
+				t.Errorf("full check of a playing host = %s, want the match with the host as character 2", result)
+			}
+		}
+	}
+	down := DefaultConfig()
+	down.State = Down
+	if result := checkLevel(t, down, "basic"); result.GoodStatus() {
+		t.Errorf("basic check of a down host = %s, want it not up", result)
+	}
+}
+
+// A sokuroll version check sends its own game id, which a host faking that
+// id accepts
+func TestCheckerRoll(t *testing.T) {
+	learn := DefaultConfig()
+	learn.AnyId = true
+	host, err := Listen("127.0.0.1:0", learn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	check := func(roll string) checker.CheckResult {
+		req, err := checker.NewRequest(host.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Timeout = 500 * time.Millisecond
+		return req.CheckVersion(checker.STATE_BASIC, roll, false)
+	}
+	if result := check("1.3"); !result.GoodStatus() {
+		t.Fatalf("sokuroll 1.3 check of a host taking any id = %s, want it up", result)
+	}
+	var rollId [16]byte
+	for _, id := range host.GameIdsSeen() {
+		if id != GameId110a {
+			rollId = id
+		}
+	}
+	if rollId == ([16]byte{}) {
+		t.Fatalf("sokuroll 1.3 check sent game ids % x, want one of its own", host.GameIdsSeen())
+	}
+
+	roll := DefaultConfig()
+	roll.GameId = rollId
+	host.SetConfig(roll)
+	if result := check("1.3"); !result.GoodStatus() {
+		t.Errorf("sokuroll 1.3 check of a sokuroll 1.3 host = %s, want it up", result)
+	}
+}
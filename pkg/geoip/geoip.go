@@ -0,0 +1,120 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+// Package geoip looks up where an address is from in local MaxMind or
+// DB-IP mmdb files.
+//
+// Country/city and ASN data usually come as separate files, so several may
+// be opened together; each lookup fills in what it can from each of them.
+// A nil DB finds nothing, so callers need not check it is configured.
+package geoip
+
+import (
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Where an address is from, as far as is known
+type Location struct {
+	Country string `json:"country,omitempty"` // ISO 3166-1 code
+	Region  string `json:"region,omitempty"`  // largest subdivision, English name
+	ASN     uint   `json:"asn,omitempty"`
+	ASOrg   string `json:"as_org,omitempty"`
+}
+
+// Command line options for opening a DB, for embedding in a go-flags
+// settings struct
+type Options struct {
+	Files []string `long:"geoip-db" value-name:"<path>" description:"Look up the country, region and ASN of host and opponent addresses in this MaxMind or DB-IP mmdb file. May be given more than once, e.g. for separate country and ASN files."`
+}
+
+// Opens the configured files, nil if there are none
+func (o *Options) Open() (*DB, error) {
+	if len(o.Files) == 0 {
+		return nil, nil
+	}
+	return Open(o.Files...)
+}
+
+type DB struct {
+	readers []*maxminddb.Reader
+}
+
+// The fields read from any of the GeoIP2/GeoLite2 or DB-IP country, city
+// and ASN databases
+type record struct {
+	Country struct {
+		IsoCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Subdivisions []struct {
+		IsoCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"subdivisions"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+func Open(paths ...string) (*DB, error) {
+	db := &DB{}
+	for _, path := range paths {
+		r, err := maxminddb.Open(path)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.readers = append(db.readers, r)
+	}
+	return db, nil
+}
+
+// Looks up an IP or ip:port address, nil if nothing is known about it
+func (db *DB) Lookup(addr string) *Location {
+	if db == nil || addr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+	var loc Location
+	for _, r := range db.readers {
+		var rec record
+		if err := r.Lookup(ip, &rec); err != nil {
+			continue
+		}
+		if loc.Country == "" {
+			loc.Country = rec.Country.IsoCode
+		}
+		if loc.Region == "" && len(rec.Subdivisions) > 0 {
+			loc.Region = rec.Subdivisions[0].Names["en"]
+			if loc.Region == "" {
+				loc.Region = rec.Subdivisions[0].IsoCode
+			}
+		}
+		if loc.ASN == 0 {
+			loc.ASN = rec.ASN
+			loc.ASOrg = rec.ASOrg
+		}
+	}
+	if loc == (Location{}) {
+		return nil
+	}
+	return &loc
+}
+
+func (db *DB) Close() error {
+	if db == nil {
+		return nil
+	}
+	var first error
+	for _, r := range db.readers {
+		if err := r.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
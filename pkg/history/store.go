@@ -0,0 +1,214 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+// Package history keeps a local on-disk record of host check results
+// so questions like "when was this host last up" can be answered without
+// going back to Parvati.
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var checksBucket = []byte("checks")
+
+// A single stored check of a host
+type Record struct {
+	HostId   int64     `json:"host_id"`
+	Time     time.Time `json:"time"`
+	Address  string    `json:"address,omitempty"`
+	Family   string    `json:"family,omitempty"` // ipv4 or ipv6
+	Status   string    `json:"status"`
+	Up       bool      `json:"up"`
+	Version  string    `json:"version,omitempty"`
+	Roll     string    `json:"sokuroll,omitempty"`
+	Spectate string    `json:"spectate,omitempty"`
+	Profiles []string  `json:"profiles,omitempty"`
+	Opponent string    `json:"opponent,omitempty"`
+}
+
+// Retention settings, a zero value disables that limit.
+type Options struct {
+	MaxAge     time.Duration // drop records older than this
+	MaxPerHost int           // keep at most this many records per host
+}
+
+type Store struct {
+	Options
+	db *bolt.DB
+}
+
+// Opens (creating if needed) the store at the given path.
+func Open(path string, opts Options) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open history store '%s': %s", path, err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(checksBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{Options: opts, db: db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+// Adds a check record to the store.
+func (s *Store) Add(r Record) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		hb, err := tx.Bucket(checksBucket).CreateBucketIfNotExists(idKey(r.HostId))
+		if err != nil {
+			return err
+		}
+		seq, err := hb.NextSequence()
+		if err != nil {
+			return err
+		}
+		return hb.Put(recordKey(r.Time, seq), data)
+	})
+}
+
+// Returns the most recent record for the host, or nil if there are none.
+func (s *Store) Last(hostId int64) (*Record, error) {
+	return s.lastMatching(hostId, func(r *Record) bool { return true })
+}
+
+// Returns the most recent record for the host where it was up, or nil if
+// it has never been seen up.
+func (s *Store) LastUp(hostId int64) (*Record, error) {
+	return s.lastMatching(hostId, func(r *Record) bool { return r.Up })
+}
+
+// Returns all records for the host checked within [from, to), oldest first.
+func (s *Store) Range(hostId int64, from, to time.Time) ([]Record, error) {
+	out := make([]Record, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket(checksBucket).Bucket(idKey(hostId))
+		if hb == nil {
+			return nil
+		}
+		end := timeKey(to)
+		c := hb.Cursor()
+		for k, v := c.Seek(timeKey(from)); k != nil && string(k) < string(end); k, v = c.Next() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			out = append(out, r)
+		}
+		return nil
+	})
+	return out, err
+}
+
+// Applies the retention settings, returning the number of records removed.
+func (s *Store) Compact(now time.Time) (int, error) {
+	removed := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(checksBucket)
+		var hosts [][]byte
+		err := root.ForEach(func(k, v []byte) error {
+			if v == nil { // nested bucket
+				hosts = append(hosts, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		var cutoff []byte
+		if s.MaxAge > 0 {
+			cutoff = timeKey(now.Add(-s.MaxAge))
+		}
+		for _, host := range hosts {
+			hb := root.Bucket(host)
+			var keys [][]byte
+			c := hb.Cursor()
+			for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			drop := 0
+			if s.MaxPerHost > 0 && len(keys) > s.MaxPerHost {
+				drop = len(keys) - s.MaxPerHost
+			}
+			for cutoff != nil && drop < len(keys) && string(keys[drop]) < string(cutoff) {
+				drop++
+			}
+			if drop == len(keys) {
+				if err := root.DeleteBucket(host); err != nil {
+					return err
+				}
+				removed += drop
+				continue
+			}
+			for _, k := range keys[:drop] {
+				if err := hb.Delete(k); err != nil {
+					return err
+				}
+			}
+			removed += drop
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (s *Store) lastMatching(hostId int64, match func(*Record) bool) (*Record, error) {
+	var found *Record
+	err := s.db.View(func(tx *bolt.Tx) error {
+		hb := tx.Bucket(checksBucket).Bucket(idKey(hostId))
+		if hb == nil {
+			return nil
+		}
+		c := hb.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var r Record
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			if match(&r) {
+				found = &r
+				return nil
+			}
+		}
+		return nil
+	})
+	return found, err
+}
+
+func idKey(id int64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(id))
+	return k
+}
+
+// Big endian nanoseconds so keys sort in time order
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return k
+}
+
+// The time key followed by the host's record sequence number, so records
+// made in the same nanosecond are all kept, in the order they were added.
+// Records stored with just a time key still sort among them by time.
+func recordKey(t time.Time, seq uint64) []byte {
+	k := make([]byte, 16)
+	copy(k, timeKey(t))
+	binary.BigEndian.PutUint64(k[8:], seq)
+	return k
+}
@@ -0,0 +1,95 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTemp(t *testing.T, opts Options) *Store {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := Open(filepath.Join(dir, "history.db"), opts)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store.Close()
+		os.RemoveAll(dir)
+	})
+	return store
+}
+
+func TestSameTimeRecordsKept(t *testing.T) {
+	store := openTemp(t, Options{})
+	when := time.Unix(1600000000, 5)
+	for _, status := range []string{"Waiting", "Playing", "Down"} {
+		if err := store.Add(Record{HostId: 1, Time: when, Status: status, Up: status != "Down"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := store.Range(1, when, when.Add(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].Status != "Waiting" || got[2].Status != "Down" {
+		t.Fatalf("Range() = %+v, want all three records in the order added", got)
+	}
+	last, err := store.Last(1)
+	if err != nil || last == nil || last.Status != "Down" {
+		t.Fatalf("Last() = %+v, %v, want the Down record", last, err)
+	}
+	up, err := store.LastUp(1)
+	if err != nil || up == nil || up.Status != "Playing" {
+		t.Fatalf("LastUp() = %+v, %v, want the Playing record", up, err)
+	}
+}
+
+func TestRangeIsHalfOpen(t *testing.T) {
+	store := openTemp(t, Options{})
+	base := time.Unix(1600000000, 0)
+	for i := 0; i < 5; i++ {
+		if err := store.Add(Record{HostId: 2, Time: base.Add(time.Duration(i) * time.Minute), Status: "Waiting"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := store.Range(2, base.Add(time.Minute), base.Add(3*time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || !got[0].Time.Equal(base.Add(time.Minute)) || !got[1].Time.Equal(base.Add(2*time.Minute)) {
+		t.Fatalf("Range() = %+v, want the records at 1m and 2m", got)
+	}
+	if none, err := store.Range(3, base, base.Add(time.Hour)); err != nil || len(none) != 0 {
+		t.Fatalf("Range() of unknown host = %+v, %v, want none", none, err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	store := openTemp(t, Options{MaxAge: time.Hour, MaxPerHost: 3})
+	now := time.Unix(1600000000, 0)
+	for i := 0; i < 5; i++ {
+		store.Add(Record{HostId: 1, Time: now.Add(-time.Duration(i) * time.Minute), Status: "Waiting"})
+	}
+	store.Add(Record{HostId: 2, Time: now.Add(-2 * time.Hour), Status: "Down"})
+	removed, err := store.Compact(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 3 {
+		t.Errorf("Compact() removed %d, want 3", removed)
+	}
+	if got, _ := store.Range(1, now.Add(-time.Hour), now.Add(time.Second)); len(got) != 3 {
+		t.Errorf("host 1 has %d records left, want 3", len(got))
+	}
+	if last, _ := store.Last(2); last != nil {
+		t.Errorf("host 2 still has %+v, want it aged out", last)
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+// Package logging is a small leveled logger with key/value fields, written
+// as text or JSON lines, shared by the commands.
+//
+// Loggers belong to a named component (e.g. "worker" or "http") whose level
+// can be set apart from the default one:
+//
+//	log := logging.New("worker").With("thread", 3)
+//	log.Info("Checked host", "host_id", 12, "status", "Waiting")
+//
+// Fields are given as alternating keys and values.
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < Debug || l > Error {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return Level(i), nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return Warn, nil
+	}
+	return Info, fmt.Errorf("Unknown log level '%s', expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// Command line options for configuring logging, for embedding in a go-flags
+// settings struct
+type Options struct {
+	Format     string   `long:"log-format" default:"text" choice:"text" choice:"json" description:"Write log lines as text or JSON objects."`
+	Level      string   `long:"log-level" default:"info" choice:"debug" choice:"info" choice:"warn" choice:"error" description:"Least severe level to log."`
+	Components []string `long:"log-component" value-name:"<component>=<level>" description:"Log this component at a different level, e.g. worker=debug. May be given more than once."`
+}
+
+// Configures logging from the options
+func (o *Options) Apply() error {
+	level, err := ParseLevel(o.Level)
+	if err != nil {
+		return err
+	}
+	overrides := make(map[string]Level, len(o.Components))
+	for _, c := range o.Components {
+		parts := strings.SplitN(c, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("Bad component level '%s', expected <component>=<level>", c)
+		}
+		l, err := ParseLevel(parts[1])
+		if err != nil {
+			return err
+		}
+		overrides[parts[0]] = l
+	}
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	config.json = o.Format == "json"
+	config.level = level
+	config.components = overrides
+	return nil
+}
+
+var config = struct {
+	lock       sync.RWMutex
+	out        io.Writer
+	json       bool
+	level      Level
+	components map[string]Level
+}{out: os.Stderr, level: Info}
+
+// Changes where log lines are written, stderr by default
+func SetOutput(w io.Writer) {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	config.out = w
+}
+
+// Changes the default level, components with their own level keep it
+func SetLevel(level Level) {
+	config.lock.Lock()
+	defer config.lock.Unlock()
+	config.level = level
+}
+
+type Logger struct {
+	component string
+	fields    []interface{}
+}
+
+func New(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// A logger adding the given key/value fields to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	return &Logger{component: l.component, fields: append(fields, kv...)}
+}
+
+// Whether lines at the level would be written, for skipping costly logging
+func (l *Logger) Enabled(level Level) bool {
+	config.lock.RLock()
+	defer config.lock.RUnlock()
+	min, ok := config.components[l.component]
+	if !ok {
+		min = config.level
+	}
+	return level >= min
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(Debug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(Info, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(Warn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(Error, msg, kv) }
+
+// Logs at error level and exits
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(Error, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := append(append([]interface{}(nil), l.fields...), kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+	now := time.Now()
+	config.lock.RLock()
+	defer config.lock.RUnlock()
+	var line []byte
+	if config.json {
+		line = jsonLine(now, level, l.component, msg, fields)
+	} else {
+		line = textLine(now, level, l.component, msg, fields)
+	}
+	config.out.Write(line)
+}
+
+func textLine(now time.Time, level Level, component string, msg string, fields []interface{}) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %-5s [%s] %s", now.Format("2006-01-02T15:04:05.000Z07:00"), strings.ToUpper(level.String()), component, msg)
+	for i := 0; i < len(fields); i += 2 {
+		value := fmt.Sprint(valueOf(fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&b, " %v=%s", fields[i], value)
+	}
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func jsonLine(now time.Time, level Level, component string, msg string, fields []interface{}) []byte {
+	obj := make(map[string]interface{}, 4+len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		obj[fmt.Sprint(fields[i])] = valueOf(fields[i+1])
+	}
+	obj["time"] = now
+	obj["level"] = level.String()
+	obj["component"] = component
+	obj["msg"] = msg
+	line, err := json.Marshal(obj)
+	if err != nil {
+		// a field which cannot be encoded, fall back to its text form
+		for k, v := range obj {
+			if _, err := json.Marshal(v); err != nil {
+				obj[k] = fmt.Sprint(v)
+			}
+		}
+		line, _ = json.Marshal(obj)
+	}
+	return append(line, '\n')
+}
+
+// Errors and durations read better as their text than their JSON encoding
+func valueOf(v interface{}) interface{} {
+	switch t := v.(type) {
+	case error:
+		return t.Error()
+	case time.Duration:
+		return t.String()
+	case fmt.Stringer:
+		return t.String()
+	}
+	return v
+}
@@ -0,0 +1,319 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+// Package netguard limits where and how fast probes may be sent, so a
+// checker cannot be used to flood a host or scan internal networks.
+//
+// Destinations are checked against a CIDR deny list (with allow list
+// exceptions), and probes are rate limited globally, per destination IP and
+// per destination network (/24 for IPv4, /64 for IPv6).
+//
+// Only the address a check is sent to can be guarded. A check going as far
+// as spectating follows the redirects hosts send it to other spectators,
+// which the guard never sees, so those checks are refused unless
+// FollowRedirects is set.
+package netguard
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrDenied      = errors.New("Destination address is not allowed")
+	ErrRateLimited = errors.New("Too many probes, try again later")
+	ErrRedirects   = errors.New("Checks following spectator redirects are not allowed")
+)
+
+// Private, loopback, link-local, multicast and other non-public ranges, and
+// the IPv6 ranges which embed or tunnel to an IPv4 address so could reach
+// any of those. IPv4-mapped addresses (::ffff:0:0/96) are parsed as plain
+// IPv4 so are already covered by the IPv4 ranges.
+var DefaultDeny = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"::/96",          // IPv4-compatible
+	"64:ff9b::/96",   // NAT64
+	"64:ff9b:1::/48", // local use NAT64
+	"2001::/32",      // Teredo
+	"2002::/16",      // 6to4
+	"fc00::/7",
+	"fe80::/10",
+	"ff00::/8",
+}
+
+// Probes per second, zero or less for no limit
+type Limits struct {
+	Global float64
+	PerIP  float64
+	PerNet float64
+}
+
+// Command line options for building a Guard, for embedding in a go-flags
+// settings struct
+type Options struct {
+	Rate       float64  `long:"probe-rate" default:"50" value-name:"<per second>" description:"Most probes to send per second in total, 0 for no limit."`
+	RatePerIP  float64  `long:"probe-rate-ip" default:"2" value-name:"<per second>" description:"Most probes to send per second to any one IP, 0 for no limit."`
+	RatePerNet float64  `long:"probe-rate-net" default:"10" value-name:"<per second>" description:"Most probes to send per second to any one /24 (/64 for IPv6), 0 for no limit."`
+	Deny       []string `long:"deny-cidr" value-name:"<cidr>" description:"Never probe addresses in this range, may be given more than once. Default private, loopback, link-local and multicast ranges, and IPv6 ranges embedding IPv4 addresses."`
+	Allow      []string `long:"allow-cidr" value-name:"<cidr>" description:"Allow probing addresses in this range even if denied, e.g. 127.0.0.1/32 for testing. May be given more than once."`
+	Redirects  bool     `long:"probe-follow-redirects" description:"Allow check levels past basic, which follow spectator redirects to addresses never checked against the deny list or rate limits."`
+}
+
+func (o *Options) Guard() (*Guard, error) {
+	g, err := New(o.Deny, o.Allow, Limits{Global: o.Rate, PerIP: o.RatePerIP, PerNet: o.RatePerNet})
+	if err != nil {
+		return nil, err
+	}
+	g.FollowRedirects = o.Redirects
+	return g, nil
+}
+
+// Forget idle per destination buckets once there are this many
+const maxBuckets = 10000
+
+type Guard struct {
+	FollowRedirects bool // whether checks may go where hosts redirect them
+
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	limits Limits
+
+	lock   sync.Mutex
+	global *bucket
+	ips    map[string]*bucket
+	nets   map[string]*bucket
+}
+
+// Creates a guard denying the given CIDRs (DefaultDeny if nil) except where
+// they are in the allow list.
+func New(deny []string, allow []string, limits Limits) (*Guard, error) {
+	if deny == nil {
+		deny = DefaultDeny
+	}
+	g := &Guard{
+		limits: limits,
+		global: newBucket(limits.Global, time.Now()),
+		ips:    make(map[string]*bucket),
+		nets:   make(map[string]*bucket),
+	}
+	var err error
+	if g.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	if g.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Returns ErrDenied if probes may never be sent to the given ip:port address
+func (g *Guard) Permitted(addr string) error {
+	ip, err := addrIP(addr)
+	if err != nil {
+		return err
+	}
+	return g.permitted(ip)
+}
+
+func (g *Guard) permitted(ip net.IP) error {
+	for _, n := range g.allow {
+		if n.Contains(ip) {
+			return nil
+		}
+	}
+	for _, n := range g.deny {
+		if n.Contains(ip) {
+			return ErrDenied
+		}
+	}
+	return nil
+}
+
+// Returns ErrRedirects unless checks may follow the redirects hosts send,
+// none of which pass through the guard
+func (g *Guard) Redirects() error {
+	if g.FollowRedirects {
+		return nil
+	}
+	return ErrRedirects
+}
+
+// Takes a probe to the given ip:port address if one is allowed right now,
+// otherwise returns ErrDenied or ErrRateLimited.
+func (g *Guard) Allow(addr string) error {
+	ip, err := addrIP(addr)
+	if err != nil {
+		return err
+	}
+	if err := g.permitted(ip); err != nil {
+		return err
+	}
+	if g.take(ip, time.Now()) > 0 {
+		return ErrRateLimited
+	}
+	return nil
+}
+
+// Like Allow but waits up to maxWait for the rate limits to allow a probe.
+func (g *Guard) Wait(addr string, maxWait time.Duration) error {
+	ip, err := addrIP(addr)
+	if err != nil {
+		return err
+	}
+	if err := g.permitted(ip); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(maxWait)
+	for {
+		now := time.Now()
+		wait := g.take(ip, now)
+		if wait == 0 {
+			return nil
+		}
+		if now.Add(wait).After(deadline) {
+			return ErrRateLimited
+		}
+		time.Sleep(wait)
+	}
+}
+
+// Takes a token from every bucket the ip falls in if all have one,
+// otherwise returns how long until they will.
+func (g *Guard) take(ip net.IP, now time.Time) time.Duration {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	buckets := []*bucket{
+		g.global,
+		g.bucketFor(g.ips, ip.String(), g.limits.PerIP, now),
+		g.bucketFor(g.nets, network(ip), g.limits.PerNet, now),
+	}
+	var wait time.Duration
+	for _, b := range buckets {
+		if w := b.wait(now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, b := range buckets {
+		b.take()
+	}
+	return 0
+}
+
+// call with the lock held
+func (g *Guard) bucketFor(buckets map[string]*bucket, key string, rate float64, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	b, ok := buckets[key]
+	if ok {
+		return b
+	}
+	if len(buckets) >= maxBuckets {
+		for k, old := range buckets {
+			if old.full(now) {
+				delete(buckets, k)
+			}
+		}
+	}
+	b = newBucket(rate, now)
+	buckets[key] = b
+	return b
+}
+
+// A token bucket allowing bursts of up to a second's worth of probes.
+// A nil bucket never limits.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate float64, now time.Time) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := math.Max(1, rate)
+	return &bucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+// Callers may race to the lock with slightly out of order times, which
+// must not take tokens away
+func (b *bucket) refill(now time.Time) {
+	if !now.After(b.last) {
+		return
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+// How long until a token is available
+func (b *bucket) wait(now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.refill(now)
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *bucket) take() {
+	if b != nil {
+		b.tokens--
+	}
+}
+
+func (b *bucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	out := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("Bad CIDR '%s': %s", c, err.Error())
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func addrIP(addr string) (net.IP, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("'%s' is not an IP address", addr)
+	}
+	return ip, nil
+}
+
+// The /24 or /64 the ip is in
+func network(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
@@ -0,0 +1,159 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package netguard
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPermitted(t *testing.T) {
+	g, err := New(nil, []string{"127.0.0.1/32"}, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		addr string
+		want error
+	}{
+		{"8.8.8.8:10800", nil},
+		{"[2606:4700::1]:10800", nil},
+		{"::ffff:8.8.8.8", nil},
+		{"127.0.0.1:10800", nil}, // allowed
+		{"127.0.0.2:10800", ErrDenied},
+		{"10.1.2.3", ErrDenied},
+		{"172.16.0.1", ErrDenied},
+		{"192.168.1.1", ErrDenied},
+		{"100.64.0.1", ErrDenied},
+		{"169.254.1.1", ErrDenied},
+		{"224.0.0.1", ErrDenied},
+		{"0.0.0.0", ErrDenied},
+		{"[::1]:10800", ErrDenied},
+		{"::", ErrDenied},
+		{"fe80::1", ErrDenied},
+		{"fd00::1", ErrDenied},
+		{"ff02::1", ErrDenied},
+		{"::ffff:10.0.0.1", ErrDenied},
+		{"::a00:1", ErrDenied},               // IPv4-compatible 10.0.0.1
+		{"64:ff9b::a00:1", ErrDenied},        // NAT64 10.0.0.1
+		{"64:ff9b:1::a00:1", ErrDenied},      // local use NAT64
+		{"2001:0:4136:e378::1", ErrDenied},   // Teredo
+		{"[2002:a00:1::1]:10800", ErrDenied}, // 6to4 10.0.0.1
+	} {
+		if got := g.Permitted(tt.addr); got != tt.want {
+			t.Errorf("Permitted(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	if err := g.Permitted("example.com:10800"); err == nil || err == ErrDenied {
+		t.Errorf("Permitted() of a name = %v, want a parse error", err)
+	}
+}
+
+func TestTake(t *testing.T) {
+	g, err := New([]string{}, nil, Limits{PerIP: 2, PerNet: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	a, b, c := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("198.51.100.1")
+	for i := 0; i < 2; i++ {
+		if wait := g.take(a, now); wait != 0 {
+			t.Fatalf("take %d of a burst of 2 waited %s", i+1, wait)
+		}
+	}
+	if wait := g.take(a, now); wait <= 0 || wait > time.Second/2 {
+		t.Errorf("third take for one IP waited %s, want up to half a second", wait)
+	}
+	if wait := g.take(b, now); wait != 0 {
+		t.Errorf("take for another IP in the /24 waited %s", wait)
+	}
+	if wait := g.take(b, now); wait <= 0 {
+		t.Error("fourth take in one /24 was not limited")
+	}
+	if wait := g.take(c, now); wait != 0 {
+		t.Errorf("take in another /24 waited %s", wait)
+	}
+	if wait := g.take(a, now.Add(time.Second)); wait != 0 {
+		t.Errorf("take a second later waited %s", wait)
+	}
+}
+
+func TestGlobalLimit(t *testing.T) {
+	g, err := New([]string{}, nil, Limits{Global: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Allow("192.0.2.1:10800"); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Allow("198.51.100.1:10800"); err != ErrRateLimited {
+		t.Errorf("second probe anywhere = %v, want ErrRateLimited", err)
+	}
+}
+
+func TestWait(t *testing.T) {
+	g, err := New(nil, nil, Limits{PerIP: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := "192.0.2.1:10800"
+	for i := 0; i < 20; i++ {
+		if err := g.Allow(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.Wait(addr, time.Millisecond); err != ErrRateLimited {
+		t.Errorf("Wait() with no time to wait = %v, want ErrRateLimited", err)
+	}
+	start := time.Now()
+	if err := g.Wait(addr, time.Second); err != nil {
+		t.Errorf("Wait() = %v, want a probe once a token is back", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("Wait() returned after %s, want about 50ms", waited)
+	}
+	if err := g.Wait("10.0.0.1:10800", time.Second); err != ErrDenied {
+		t.Errorf("Wait() for a denied address = %v, want ErrDenied", err)
+	}
+}
+
+func TestIdleBucketsEvicted(t *testing.T) {
+	g, err := New([]string{}, nil, Limits{PerIP: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 0; i < maxBuckets; i++ {
+		g.take(net.ParseIP(fmt.Sprintf("2001:db8::%x", i)), now)
+	}
+	busy := net.ParseIP("2001:db8::1:0")
+	g.take(busy, now.Add(2*time.Second))
+	if len(g.ips) != 1 {
+		t.Fatalf("%d per IP buckets after the limit, want the idle ones evicted", len(g.ips))
+	}
+	g.take(net.ParseIP("2001:db8::1:1"), now.Add(2*time.Second))
+	if wait := g.take(busy, now.Add(2*time.Second)); wait == 0 {
+		t.Error("bucket in use was evicted")
+	}
+}
+
+// Redirects lead to addresses the guard never sees, denied or not
+func TestRedirects(t *testing.T) {
+	var o Options
+	g, err := o.Guard()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Redirects(); err != ErrRedirects {
+		t.Errorf("Redirects() = %v, want ErrRedirects by default", err)
+	}
+	o.Redirects = true
+	if g, err = o.Guard(); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Redirects(); err != nil {
+		t.Errorf("Redirects() = %v with --probe-follow-redirects, want nil", err)
+	}
+}
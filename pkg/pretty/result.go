@@ -3,6 +3,7 @@
 package pretty
 
 import (
+	"github.com/misatosangel/parvati-soku-checker/pkg/profile"
 	"github.com/misatosangel/soku-cardinfo/pkg/card-info"
 	"github.com/misatosangel/soku-net-checker/pkg/checker"
 )
@@ -36,15 +37,16 @@ type GameInfo struct {
 }
 
 type Result struct {
-	Address   string    `json:"address,omitempty"`
-	Status    string    `json:"status,omitempty"`
-	Error     string    `json:"error,omitempty"`
-	Version   string    `json:"version,omitempty"`
-	Opponent  string    `json:"opponent,omitempty"`
-	Spectate  string    `json:"spectate,omitempty"`
-	Profiles  []string  `json:"profiles,omitempty"`
-	SpecChain []string  `json:"spec_chain,omitempty"`
-	Game      *GameInfo `json:"game,omitempty"`
+	Address     string    `json:"address,omitempty"`
+	Status      string    `json:"status,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Version     string    `json:"version,omitempty"`
+	Opponent    string    `json:"opponent,omitempty"`
+	Spectate    string    `json:"spectate,omitempty"`
+	Profiles    []string  `json:"profiles,omitempty"`
+	RawProfiles []string  `json:"raw_profiles,omitempty"` // hex of the bytes sent
+	SpecChain   []string  `json:"spec_chain,omitempty"`
+	Game        *GameInfo `json:"game,omitempty"`
 }
 
 func MarkupResult(raw checker.CheckResult, cards cardinfo.AllCards) Result {
@@ -58,16 +60,23 @@ func MarkupResult(raw checker.CheckResult, cards cardinfo.AllCards) Result {
 		spec = "unknown"
 	}
 
+	var names, rawNames []string
+	for _, p := range profile.NormaliseAll(raw.Profiles) {
+		names = append(names, p.Name)
+		rawNames = append(rawNames, p.Raw)
+	}
+
 	return Result{
-		Address:   raw.Address,
-		Status:    raw.Status,
-		Error:     raw.Error,
-		Version:   raw.Version,
-		Opponent:  raw.Opponent,
-		Profiles:  raw.Profiles,
-		SpecChain: raw.Spec,
-		Spectate:  spec,
-		Game:      MarkupGame(raw.CurGame, cards),
+		Address:     raw.Address,
+		Status:      raw.Status,
+		Error:       raw.Error,
+		Version:     raw.Version,
+		Opponent:    raw.Opponent,
+		Profiles:    names,
+		RawProfiles: rawNames,
+		SpecChain:   raw.Spec,
+		Spectate:    spec,
+		Game:        MarkupGame(raw.CurGame, cards),
 	}
 }
 
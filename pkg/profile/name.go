@@ -0,0 +1,128 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+// Package profile turns the profile names sent by Soku hosts into clean
+// UTF-8 text.
+//
+// The game sends each name as a fixed size, NUL padded field in Shift-JIS,
+// so Japanese names come out as mojibake if used as they are. The raw bytes
+// are kept alongside as hex for when the decoding gets it wrong.
+package profile
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+type Name struct {
+	Name string `json:"name"`
+	Raw  string `json:"raw,omitempty"` // hex of the bytes as received
+}
+
+// Decodes and cleans up a profile name as received from a host
+func Normalise(raw string) Name {
+	b := []byte(raw)
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return Name{Name: clean(decode(b)), Raw: hex.EncodeToString([]byte(raw))}
+}
+
+// Normalises each of the names
+func NormaliseAll(raw []string) []Name {
+	if raw == nil {
+		return nil
+	}
+	out := make([]Name, len(raw))
+	for i, r := range raw {
+		out[i] = Normalise(r)
+	}
+	return out
+}
+
+// Just the clean names of each, for where the raw bytes are not wanted
+func Names(raw []string) []string {
+	if raw == nil {
+		return nil
+	}
+	out := make([]string, len(raw))
+	for i, r := range raw {
+		out[i] = Normalise(r).Name
+	}
+	return out
+}
+
+// Shift-JIS as the game sends, unless the bytes are also valid UTF-8 (e.g.
+// a name already decoded by something in between) which reads at least as
+// likely a name. Short Shift-JIS names can be valid UTF-8, half width
+// katakana pairs reading as IPA or modifier letters, and UTF-8 accented
+// letters read as Shift-JIS half width katakana, so neither is taken on
+// validity alone.
+func decode(b []byte) string {
+	if isASCII(b) {
+		return string(b)
+	}
+	out, err := japanese.ShiftJIS.NewDecoder().Bytes(b)
+	sjis := err == nil && !bytes.ContainsRune(out, utf8.RuneError)
+	switch {
+	case sjis && utf8.Valid(b):
+		if unlikeliness(string(b)) <= unlikeliness(string(out)) {
+			return string(b)
+		}
+		return string(out)
+	case sjis:
+		return string(out)
+	case utf8.Valid(b):
+		return string(b)
+	case err == nil:
+		return string(out)
+	}
+	return strings.ToValidUTF8(string(b), string(utf8.RuneError))
+}
+
+// How unlikely the text is as a name: characters seldom seen in names, or
+// typical of mojibake, add to the score
+func unlikeliness(s string) int {
+	score := 0
+	for _, r := range s {
+		switch {
+		case r < utf8.RuneSelf,
+			r >= 0xc0 && r <= 0xff && r != 0xd7 && r != 0xf7, // Latin-1 letters
+			r >= 0x3000 && r <= 0x30ff,                       // CJK punctuation, hiragana and katakana
+			r >= 0x4e00 && r <= 0x9fff,                       // CJK unified ideographs
+			r >= 0xff01 && r <= 0xff5e:                       // full width ASCII
+		case r >= 0xff61 && r <= 0xff9f, // half width katakana
+			r >= 0x100 && r <= 0x17f, // Latin Extended-A
+			r >= 0x391 && r <= 0x3c9, // basic Greek
+			r >= 0x410 && r <= 0x44f: // basic Cyrillic
+			score++
+		default:
+			score += 3
+		}
+	}
+	return score
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// Drops control characters and trailing padding, including full width spaces
+func clean(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, s)
+	return strings.TrimRightFunc(s, unicode.IsSpace)
+}
@@ -0,0 +1,40 @@
+// Copyright 2017-2020 misatos.angel@gmail.com.  All rights reserved.
+
+package profile
+
+import "testing"
+
+func TestNormalise(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		raw  string
+		want string
+	}{
+		{"ascii", "alice", "alice"},
+		{"shift-jis", "\x82\xa0\x82\xa2", "あい"},
+		{"shift-jis half width", "\xb1\xb2", "ｱｲ"},
+		{"shift-jis mixed", "bob\x82\xa0", "bobあ"},
+		{"utf-8", "caf\xc3\xa9", "café"},
+		{"utf-8 japanese", "あい", "あい"},
+		{"shift-jis valid utf-8 kana", "\xca\xb2", "ﾊｲ"},
+		{"shift-jis valid utf-8 kana latin", "\xc6\xba", "ﾆｺ"},
+		{"shift-jis valid utf-8 kanji", "\xe4\xa1\xb1", "茖ｱ"},
+		{"utf-8 cyrillic", "Саша", "Саша"},
+		{"nul padded", "alice\x00\x00\x00", "alice"},
+		{"nul padded shift-jis", "\x82\xa0\x00garbage", "あ"},
+		{"control characters", "al\x01ice\x1b\n", "alice"},
+		{"trailing full width spaces", "\x82\xa0\x81\x40\x81\x40", "あ"},
+		{"trailing spaces", "alice  ", "alice"},
+		{"empty", "", ""},
+	} {
+		if got := Normalise(tt.raw); got.Name != tt.want {
+			t.Errorf("%s: Normalise(%q) = %q, want %q", tt.name, tt.raw, got.Name, tt.want)
+		}
+	}
+}
+
+func TestNormaliseKeepsRaw(t *testing.T) {
+	if got := Normalise("a\x00b"); got.Raw != "610062" {
+		t.Errorf("Normalise() raw = %q, want the hex of every byte received", got.Raw)
+	}
+}